@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/spf13/cobra"
+	"oras.land/oras-go/v2"
+
+	"github.com/thin-edge/tedge-oscar/internal/artifact"
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/registryauth"
+)
+
+var copyImageCmd = &cobra.Command{
+	Use:   "copy [source] [destination]",
+	Short: "Copy a flow image from one registry to another",
+	Long: `Copy a flow image from one registry (or repository) to another, along with its referrers
+(e.g. signatures). The manifest is copied as is, so the image keeps its digest and annotations.
+If the destination has no tag or digest, then the tag and digest of the source are used.`,
+	Aliases: []string{"cp"},
+	Example: `# Promote an image from the dev to the production registry
+$ tedge-oscar flows images copy dev.example.com/flows/counter:1.0 ghcr.io/thin-edge/counter:1.0`,
+	Args:         cobra.ExactArgs(2),
+	SilenceUsage: true, // Do not show help on runtime errors
+	RunE: func(cmd *cobra.Command, args []string) error {
+		registryauth.SetDebugHTTP(logLevel)
+		cfgPath := configPath
+		if cfgPath == "" {
+			cfgPath = config.DefaultConfigPath()
+		}
+		cfg, err := config.LoadConfig(cfgPath)
+		if err != nil {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
+		srcRef, err := artifact.ParseReference(args[0])
+		if err != nil {
+			return err
+		}
+		dstRef, err := artifact.ParseReference(args[1])
+		if err != nil {
+			return err
+		}
+		if srcRef.Reference() == "" {
+			return fmt.Errorf("source image reference must include a tag or digest, e.g. ghcr.io/user/repo:tag or @sha256:<hash>")
+		}
+		if srcRef.Registry == artifact.LocalRegistry || dstRef.Registry == artifact.LocalRegistry {
+			return fmt.Errorf("images can only be copied between registries")
+		}
+		dstRef, err = artifact.CopyDestination(srcRef, dstRef)
+		if err != nil {
+			return err
+		}
+
+		src, err := registryauth.NewRepository(cfg, srcRef)
+		if err != nil {
+			return err
+		}
+		dst, err := registryauth.NewRepository(cfg, dstRef)
+		if err != nil {
+			return err
+		}
+		opts := oras.DefaultExtendedCopyOptions
+		if srcRef.Registry == dstRef.Registry {
+			// Blobs are mounted rather than uploaded again within the same registry
+			opts.MountFrom = func(ctx context.Context, desc ocispec.Descriptor) ([]string, error) {
+				return []string{srcRef.Repository}, nil
+			}
+		}
+		// The source is resolved by digest if it has one, while the destination is tagged if it has a tag
+		desc, err := oras.ExtendedCopy(cmd.Context(), src, srcRef.Reference(), dst, dstRef.Version(), opts)
+		if err != nil {
+			return fmt.Errorf("failed to copy image: %w", err)
+		}
+		fmt.Fprintf(cmd.ErrOrStderr(), "Image %s copied to %s (digest: %s)\n", srcRef, dstRef, desc.Digest)
+		return nil
+	},
+}
+
+func init() {
+	imagesCmd.AddCommand(copyImageCmd)
+}
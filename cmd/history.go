@@ -0,0 +1,288 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/spf13/cobra"
+	"github.com/thin-edge/tedge-oscar/internal/artifact"
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/history"
+	"github.com/thin-edge/tedge-oscar/internal/imagepull"
+	"github.com/thin-edge/tedge-oscar/internal/imagestore"
+	"github.com/thin-edge/tedge-oscar/internal/util"
+	"github.com/thin-edge/tedge-oscar/pkg/types/flows"
+)
+
+var historyInstanceCmd = &cobra.Command{
+	Use:   "history [instance_name]",
+	Short: "List the revisions of a deployed flow instance",
+	Example: `# List the revisions of an instance
+$ tedge-oscar flows instances history myinstance`,
+	Args:              cobra.ExactArgs(1),
+	SilenceUsage:      true, // Do not show help on runtime errors
+	ValidArgsFunction: completeInstanceNames,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		outputFormat, err := cmd.Flags().GetString("output")
+		if err != nil {
+			return err
+		}
+		selectCols, err := cmd.Flags().GetString("select")
+		if err != nil {
+			return err
+		}
+		var colNames []string
+		if selectCols != "" {
+			colNames = strings.Split(selectCols, ",")
+		} else {
+			colNames = []string{"revision", "deployedAt", "image", "current", "digest"}
+		}
+		cfgPath := configPath
+		if cfgPath == "" {
+			cfgPath = config.DefaultConfigPath()
+		}
+		cfg, err := config.LoadConfig(cfgPath)
+		if err != nil {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
+		mapper := "local"
+		if v, err := cmd.Flags().GetString("mapper"); err == nil {
+			mapper = v
+		}
+		deployDir, err := cfg.GetDeployDir(mapper)
+		if err != nil {
+			return fmt.Errorf("failed to evaluate deployDir: %w", err)
+		}
+		h, err := history.Load(deployDir, args[0])
+		if err != nil {
+			return err
+		}
+		if len(h.Revisions) == 0 {
+			fmt.Fprintf(cmd.ErrOrStderr(), "Instance %s has no history.\n", args[0])
+			return nil
+		}
+		current, _ := h.Current()
+		rows := [][]string{}
+		for _, rev := range h.Revisions {
+			rowMap := map[string]string{
+				"revision":   strconv.Itoa(rev.Revision),
+				"deployedAt": rev.DeployedAt.Format(time.RFC3339),
+				"image":      rev.Image,
+				"requested":  rev.Requested,
+				"digest":     rev.Digest,
+				"source":     rev.Source,
+				"pinned":     strconv.FormatBool(rev.Pinned),
+				"current":    strconv.FormatBool(rev.Revision == current.Revision),
+			}
+			row := make([]string, len(colNames))
+			for i, col := range colNames {
+				row[i] = rowMap[col]
+			}
+			rows = append(rows, row)
+		}
+		return renderRows(cmd.OutOrStdout(), outputFormat, colNames, rows)
+	},
+}
+
+var rollbackInstanceCmd = &cobra.Command{
+	Use:   "rollback [instance_name]",
+	Short: "Roll back a deployed flow instance to a previous revision",
+	Long: `Roll back a deployed flow instance to a previous revision.
+The instance file of the revision is restored as is, and the files of an instance using the dir layout
+are copied again from the image of the revision. If the image of the revision has been removed
+(e.g. by prune) or its tag now points to a different digest, then the image is pulled again by digest.`,
+	Example: `# Roll back an instance to the revision before the current one
+$ tedge-oscar flows instances rollback myinstance
+
+# Roll back an instance to revision 3 (see "tedge-oscar flows instances history myinstance")
+$ tedge-oscar flows instances rollback myinstance --to 3`,
+	Args:              cobra.ExactArgs(1),
+	SilenceUsage:      true, // Do not show help on runtime errors
+	ValidArgsFunction: completeInstanceNames,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfgPath := configPath
+		if cfgPath == "" {
+			cfgPath = config.DefaultConfigPath()
+		}
+		cfg, err := config.LoadConfig(cfgPath)
+		if err != nil {
+			return err
+		}
+		instanceName := args[0]
+		to, err := cmd.Flags().GetInt("to")
+		if err != nil {
+			return err
+		}
+		pullPolicy := cfg.PullPolicy
+		if cmd.Flags().Changed("pull") {
+			pullPolicy, _ = cmd.Flags().GetString("pull")
+			if err := config.ValidatePullPolicy(pullPolicy); err != nil {
+				return err
+			}
+		}
+		mapper := "local"
+		if v, err := cmd.Flags().GetString("mapper"); err == nil {
+			mapper = v
+		}
+		deployDir, err := cfg.GetDeployDir(mapper)
+		if err != nil {
+			return fmt.Errorf("failed to evaluate deployDir: %w", err)
+		}
+		if _, err := os.Stat(deployDir); err != nil {
+			return fmt.Errorf("failed to read deploy dir: %w", err)
+		}
+		deployDirLock, err := lockDeployDir(cmd, deployDir)
+		if err != nil {
+			return err
+		}
+		defer deployDirLock.Release()
+
+		layout := config.LayoutFile
+		if _, existing, err := findInstance(deployDir, instanceName); err == nil {
+			layout = existing
+		}
+		h, err := history.Load(deployDir, instanceName)
+		if err != nil {
+			return err
+		}
+		var target history.Revision
+		var ok bool
+		if to > 0 {
+			if target, ok = h.Get(to); !ok {
+				return fmt.Errorf("instance %s has no revision %d", instanceName, to)
+			}
+		} else if target, ok = h.Previous(); !ok {
+			return fmt.Errorf("instance %s has no previous revision", instanceName)
+		}
+		if current, _ := h.Current(); current.Revision == target.Revision {
+			fmt.Fprintf(cmd.ErrOrStderr(), "Instance %s is already at revision %d\n", instanceName, target.Revision)
+			return nil
+		}
+
+		// The image_dir is locked while checking for and pulling the image
+		imageDirLock, err := lockImageDir(cmd, cfg)
+		if err != nil {
+			return err
+		}
+		defer imageDirLock.Release()
+		store := imagestore.New(cfg.ImageDir)
+		data, imagePath, err := ensureRevisionImage(cmd, cfg, store, target, layout, pullPolicy)
+		if err != nil {
+			return err
+		}
+		if layout == config.LayoutDir {
+			// The files of the image of the revision are copied again while the image_dir is still locked,
+			// keeping the params of the instance
+			if _, err := deployInstanceDir(cmd.Context(), deployDir, instanceName, imagePath, data, nil); err != nil {
+				return err
+			}
+		}
+		if err := imageDirLock.Release(); err != nil {
+			return err
+		}
+
+		if layout == config.LayoutFile {
+			tomlPath := filepath.Join(deployDir, instanceName+".toml")
+			if err := writeInstanceFile(cmd.Context(), tomlPath, data); err != nil {
+				return err
+			}
+		}
+		entry := target.Entry
+		entry.DeployedAt = time.Now().UTC().Truncate(time.Second)
+		if err := recordInstance(cfg, deployDir, instanceName, entry, data); err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.ErrOrStderr(), "Instance %s rolled back to revision %d (image: %s, digest: %s)\n", instanceName, target.Revision, target.Image, target.Digest)
+		return nil
+	},
+}
+
+// ensureRevisionImage makes sure that the image of a revision is available with the content it had when the
+// revision was deployed, pulling the image by digest into the folder of the digest if needed. It returns the instance
+// file of the revision and the folder of its image. The scripts of an instance using the file layout are updated to
+// the folder of the digest if the image had to be pulled, while those of the dir layout are relative to the instance folder.
+func ensureRevisionImage(cmd *cobra.Command, cfg *config.Config, store *imagestore.Store, rev history.Revision, layout string, pullPolicy string) (map[string]interface{}, string, error) {
+	var data map[string]interface{}
+	if _, err := toml.Decode(rev.Instance, &data); err != nil {
+		return nil, "", fmt.Errorf("failed to parse revision %d: %w", rev.Revision, err)
+	}
+	var file flows.InstanceFile
+	if _, err := toml.Decode(rev.Instance, &file); err != nil {
+		return nil, "", fmt.Errorf("failed to parse revision %d: %w", rev.Revision, err)
+	}
+	script := file.Script()
+	if rev.Image == "" {
+		if layout == config.LayoutDir {
+			return nil, "", fmt.Errorf("the image of revision %d is unknown", rev.Revision)
+		}
+		return data, "", nil
+	}
+	if script == "" && layout == config.LayoutFile {
+		return data, "", nil
+	}
+	ref, err := artifact.ParseReference(rev.Image)
+	if err != nil {
+		return nil, "", err
+	}
+	// The folder the revision was deployed from (e.g. the folder of the tag), which may no longer exist
+	dir, _ := store.Lookup(ref)
+	if layout == config.LayoutFile {
+		if img, err := store.FindImage(script); err == nil {
+			dir = img.Dir
+		}
+	}
+	if imagestore.IsComplete(dir) && (rev.Digest == "" || imagestore.ReadAnnotation(dir, imagestore.AnnotationDigest) == rev.Digest) {
+		return data, dir, nil
+	}
+
+	switch {
+	case rev.Digest == "":
+		return nil, "", fmt.Errorf("image %s of revision %d is no longer available and its digest is unknown", ref, rev.Revision)
+	case ref.Registry == artifact.LocalRegistry:
+		return nil, "", fmt.Errorf("image %s of revision %d is no longer available, load it again", ref, rev.Revision)
+	case pullPolicy == config.PullNever:
+		return nil, "", fmt.Errorf("image %s of revision %d is no longer available and the pull policy is %s", ref, rev.Revision, config.PullNever)
+	}
+	// The image of the revision is stored by digest, as the folder of a tag is replaced when the tag is pulled again
+	pullRef := ref
+	pullRef.Digest = rev.Digest
+	target := store.Path(pullRef)
+	if !imagestore.IsComplete(target) {
+		fmt.Fprintf(cmd.ErrOrStderr(), "Image %s of revision %d is not available locally. Pulling...\n", pullRef, rev.Revision)
+		result, err := imagepull.PullImage(cmd.Context(), cfg, pullRef, target, "", false)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to pull image: %w", err)
+		}
+		fmt.Fprintf(cmd.ErrOrStderr(), "Image %s pulled (source: %s, digest: %s)\n", pullRef, result.Source.Name(), result.Digest)
+	}
+	if err := moveScripts(data, dir, target); err != nil {
+		return nil, "", err
+	}
+	return data, target, nil
+}
+
+func init() {
+	defaultOutput := "jsonl"
+	if util.Isatty(os.Stdout.Fd()) {
+		defaultOutput = "table"
+	}
+	historyInstanceCmd.Flags().String("mapper", "local", "Mapper the flow is deployed to")
+	historyInstanceCmd.Flags().StringP("output", "o", defaultOutput, "Output format: table|jsonl|tsv")
+	historyInstanceCmd.Flags().String("select", "", "Comma separated list of columns to display (e.g. revision,deployedAt,image,requested,digest,source,pinned,current)")
+	_ = historyInstanceCmd.RegisterFlagCompletionFunc("output", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{"table", "jsonl", "tsv"}, cobra.ShellCompDirectiveNoFileComp
+	})
+
+	rollbackInstanceCmd.Flags().String("mapper", "local", "Mapper the flow is deployed to")
+	rollbackInstanceCmd.Flags().Int("to", 0, "Revision to roll back to (default: the revision before the current one)")
+	rollbackInstanceCmd.Flags().String("pull", "", "Pull policy used if the image of the revision is no longer available: always|if-not-present|never (default: pull_policy setting of the config, or if-not-present)")
+	_ = rollbackInstanceCmd.RegisterFlagCompletionFunc("pull", completePullPolicies)
+
+	instancesCmd.AddCommand(historyInstanceCmd)
+	instancesCmd.AddCommand(rollbackInstanceCmd)
+}
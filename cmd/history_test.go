@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/thin-edge/tedge-oscar/internal/history"
+)
+
+func TestUpgradeAndRollbackDirLayout(t *testing.T) {
+	env := newTestEnv(t)
+	for _, version := range []string{"1.0", "2.0"} {
+		tarball := filepath.Join(t.TempDir(), "counter:"+version+".tar")
+		writeTarball(t, tarball, map[string]string{
+			"flow.toml":   "version = \"" + version + "\"\n" + testFlow,
+			"lib/main.js": "// " + version,
+		})
+		if _, err := env.run(t, "flows", "images", "load", tarball); err != nil {
+			t.Fatal(err)
+		}
+	}
+	script := filepath.Join(env.DeployDir, "a", "lib", "main.js")
+	assertScript := func(want string) {
+		t.Helper()
+		b, err := os.ReadFile(script)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != want {
+			t.Fatalf("unexpected script of the instance. got=%q, expected=%q", b, want)
+		}
+	}
+
+	if _, err := env.run(t, "flows", "instances", "deploy", "a", "counter:1.0", "--layout", "dir", "--pull", "never"); err != nil {
+		t.Fatal(err)
+	}
+	assertScript("// 1.0")
+	if _, err := env.run(t, "flows", "instances", "upgrade", "a", "counter:2.0", "--pull", "never", "--yes"); err != nil {
+		t.Fatal(err)
+	}
+	assertScript("// 2.0")
+
+	h, err := history.Load(env.DeployDir, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.Revisions) != 2 {
+		t.Fatalf("expected 2 revisions, got %d", len(h.Revisions))
+	}
+	if _, err := env.run(t, "flows", "instances", "rollback", "a", "--pull", "never"); err != nil {
+		t.Fatal(err)
+	}
+	assertScript("// 1.0")
+	b, err := os.ReadFile(filepath.Join(env.DeployDir, "a", flowFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(b); !strings.Contains(got, `script = "lib/main.js"`) || !strings.Contains(got, `version = "1.0"`) {
+		t.Fatalf("unexpected instance file after rollback: %s", got)
+	}
+}
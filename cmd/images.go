@@ -1,17 +1,15 @@
 package cmd
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
-	"path/filepath"
 	"strings"
 
-	"github.com/olekukonko/tablewriter"
 	"github.com/spf13/cobra"
 
-	"github.com/thin-edge/tedge-oscar/internal/artifact"
 	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/imagestore"
+	"github.com/thin-edge/tedge-oscar/internal/lock"
 	"github.com/thin-edge/tedge-oscar/internal/util"
 )
 
@@ -61,51 +59,45 @@ var listImagesCmd = &cobra.Command{
 			return err
 		}
 
-		imageDir := cfg.ImageDir
 		unexpandedImageDir := cfg.UnexpandedImageDir
-		if imageDir == "" {
+		if cfg.ImageDir == "" {
 			return fmt.Errorf("image_dir not set in config")
 		}
+		store := imagestore.New(cfg.ImageDir)
 		// Don't fail if directory does not exist
-		entries, err := os.ReadDir(imageDir)
+		images, err := store.List()
 		if err != nil {
-			if !os.IsNotExist(err) {
-				return fmt.Errorf("failed to read image_dir. Check the permissions of the folder. %w", err)
-			}
+			return fmt.Errorf("failed to read image_dir. Check the permissions of the folder. %w", err)
 		}
 		rows := [][]string{}
-		for _, entry := range entries {
-			if !entry.IsDir() {
-				continue
-			}
-			imageDir := filepath.Join(imageDir, entry.Name())
-			manifestPath := filepath.Join(imageDir, "manifest.json")
-			version := "<unknown>"
+		for _, img := range images {
+			version := img.Reference.Version()
 			digest := "<unknown>"
-			if f, err := os.Open(manifestPath); err == nil {
-				var manifest map[string]interface{}
-				if err := json.NewDecoder(f).Decode(&manifest); err == nil {
-					if ann, ok := manifest["annotations"].(map[string]interface{}); ok {
-						if v, ok := ann["org.opencontainers.image.version"].(string); ok {
-							version = v
-						}
-					}
-					if d, ok := manifest["config"].(map[string]interface{}); ok {
-						if dgst, ok := d["digest"].(string); ok {
-							digest = dgst
-						}
+			if manifest, err := imagestore.ReadManifest(img.Dir); err == nil {
+				if ann, ok := manifest["annotations"].(map[string]interface{}); ok {
+					if v, ok := ann["org.opencontainers.image.version"].(string); ok {
+						version = v
 					}
-					if d, ok := manifest["digest"].(string); ok && d != "" {
-						digest = d
+				}
+				if d, ok := manifest["config"].(map[string]interface{}); ok {
+					if dgst, ok := d["digest"].(string); ok {
+						digest = dgst
 					}
 				}
-				f.Close()
+				if d, ok := manifest["digest"].(string); ok && d != "" {
+					digest = d
+				}
+			}
+			if d := imagestore.ReadAnnotation(img.Dir, imagestore.AnnotationDigest); d != "" {
+				digest = d
 			}
 			rowMap := map[string]string{
-				"image":    artifact.TrimVersion(entry.Name()),
-				"version":  version,
-				"digest":   digest,
-				"imageDir": imageDir,
+				"image":     img.Name(),
+				"version":   version,
+				"digest":    digest,
+				"reference": img.String(),
+				"source":    imagestore.ReadAnnotation(img.Dir, imagestore.AnnotationSource),
+				"imageDir":  img.Dir,
 			}
 			row := make([]string, len(colNames))
 			for i, col := range colNames {
@@ -118,69 +110,74 @@ var listImagesCmd = &cobra.Command{
 			return nil
 		}
 
-		if outputFormat == "jsonl" || outputFormat == "json" {
-			for _, row := range rows {
-				obj := map[string]string{}
-				for i, col := range colNames {
-					obj[col] = row[i]
-				}
-				enc := json.NewEncoder(cmd.OutOrStdout())
-				enc.SetEscapeHTML(false)
-				if err := enc.Encode(obj); err != nil {
-					return err
-				}
-			}
-			return nil
-		}
-		if outputFormat == "tsv" {
-			for _, row := range rows {
-				fmt.Fprintln(cmd.OutOrStdout(), strings.Join(row, "\t"))
-			}
-			return nil
-		}
-		maxWidth := 0
-		tablePadding := 2 // left + right border
-		columnPadding := 2
-		if w, _, err := terminalSize(); err == nil {
-			maxWidth = w - tablePadding
-		} else {
-			maxWidth = 120 // fallback
-		}
-		colWidths := make([]int, len(colNames))
-		for i := range colNames {
-			colWidths[i] = len(colNames[i]) + columnPadding
-		}
-		for _, row := range rows {
-			for i, cell := range row {
-				if l := len(cell); l > colWidths[i] {
-					colWidths[i] = l + columnPadding
-				}
-			}
-		}
-		total := len(colNames) - 1 // for separators
-		for _, w := range colWidths {
-			total += w
-		}
-		keep := len(colNames)
-		for total > maxWidth && keep > 1 {
-			keep--
-			total -= colWidths[keep] + 1
-		}
-		filteredColNames := colNames[:keep]
-		filteredRows := [][]string{}
-		for _, row := range rows {
-			filteredRows = append(filteredRows, row[:keep])
+		return renderRows(cmd.OutOrStdout(), outputFormat, colNames, rows)
+	},
+}
+
+// lockImageDir takes the lock of the image_dir, which must be held while writing to it. Once the lock is held,
+// any images stored using the legacy layout are migrated, as the migration moves and marks image folders.
+func lockImageDir(cmd *cobra.Command, cfg *config.Config) (*lock.Lock, error) {
+	l, err := lock.Acquire(cmd.Context(), cfg.ImageDir, lockTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := imagestore.New(cfg.ImageDir).Migrate(); err != nil {
+		_ = l.Release()
+		return nil, fmt.Errorf("failed to migrate image_dir: %w", err)
+	}
+	return l, nil
+}
+
+// completeImages returns the locally stored images matching the given prefix
+func completeImages(toComplete string) ([]string, cobra.ShellCompDirective) {
+	cfgPath := configPath
+	if cfgPath == "" {
+		cfgPath = config.DefaultConfigPath()
+	}
+	cfg, err := config.LoadConfig(cfgPath)
+	if err != nil || cfg.ImageDir == "" {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	images, err := imagestore.New(cfg.ImageDir).List()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	var completions []string
+	for _, img := range images {
+		name := img.String()
+		if strings.HasPrefix(name, toComplete) {
+			completions = append(completions, name)
 		}
-		colHeaders := make([]any, len(filteredColNames))
-		for i, v := range filteredColNames {
-			colHeaders[i] = v
+	}
+	return completions, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeImageVersions returns the locally stored images matching the given prefix. Once a tag is
+// being completed (e.g. ghcr.io/thin-edge/counter:1), the tags of the repository in the registry are included.
+func completeImageVersions(cmd *cobra.Command, toComplete string) ([]string, cobra.ShellCompDirective) {
+	completions, directive := completeImages(toComplete)
+	i := strings.LastIndex(toComplete, ":")
+	if i == -1 || i < strings.LastIndex(toComplete, "/") {
+		return completions, directive
+	}
+	cfgPath := configPath
+	if cfgPath == "" {
+		cfgPath = config.DefaultConfigPath()
+	}
+	cfg, err := config.LoadConfig(cfgPath)
+	if err != nil {
+		return completions, directive
+	}
+	seen := make(map[string]bool, len(completions))
+	for _, c := range completions {
+		seen[c] = true
+	}
+	for _, c := range completeRemoteTags(cmd, cfg, toComplete[:i]) {
+		if !seen[c] && strings.HasPrefix(c, toComplete) {
+			completions = append(completions, c)
 		}
-		table := tablewriter.NewTable(cmd.OutOrStdout())
-		table.Header(colHeaders...)
-		table.Bulk(filteredRows)
-		table.Render()
-		return nil
-	},
+	}
+	return completions, cobra.ShellCompDirectiveNoFileComp
 }
 
 func init() {
@@ -189,11 +186,12 @@ func init() {
 		defaultOutput = "table"
 	}
 	listImagesCmd.Flags().StringP("output", "o", defaultOutput, "Output format: table|jsonl|tsv")
-	listImagesCmd.Flags().String("select", "", "Comma separated list of columns to display (e.g. image,version,digest)")
+	listImagesCmd.Flags().String("select", "", "Comma separated list of columns to display (e.g. image,version,digest,reference,source)")
 	_ = listImagesCmd.RegisterFlagCompletionFunc("output", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
 		return []string{"table", "jsonl", "tsv"}, cobra.ShellCompDirectiveNoFileComp
 	})
 	imagesCmd.AddCommand(listImagesCmd)
 	imagesCmd.AddCommand(saveCmd)
 	imagesCmd.AddCommand(removeImageCmd)
+	imagesCmd.AddCommand(pruneImagesCmd)
 }
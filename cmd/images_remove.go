@@ -2,49 +2,74 @@ package cmd
 
 import (
 	"fmt"
-	"os"
 	"path/filepath"
-	"strings"
 
 	"github.com/spf13/cobra"
+	"github.com/thin-edge/tedge-oscar/internal/artifact"
 	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/imagestore"
 )
 
 var removeImageCmd = &cobra.Command{
-	Use:     "remove [image_folder]",
-	Short:   "Remove a flow image version (by folder name)",
+	Use:     "remove [image]",
+	Short:   "Remove a flow image version",
 	Aliases: []string{"rm"},
-	Example: `tedge-oscar flows images remove myimage:1.0.0`,
+	Example: `tedge-oscar flows images remove ghcr.io/thin-edge/connectivity-counter:1.0`,
 	Args:    cobra.ExactArgs(1),
 	ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return completeImages(toComplete)
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
 		cfgPath := configPath
 		if cfgPath == "" {
 			cfgPath = config.DefaultConfigPath()
 		}
 		cfg, err := config.LoadConfig(cfgPath)
 		if err != nil {
-			return nil, cobra.ShellCompDirectiveNoFileComp
+			return err
 		}
-		imageDir := cfg.ImageDir
-		if imageDir == "" {
-			return nil, cobra.ShellCompDirectiveNoFileComp
+		if cfg.ImageDir == "" {
+			return fmt.Errorf("image_dir not set in config")
 		}
-		entries, err := os.ReadDir(imageDir)
+		imageDirLock, err := lockImageDir(cmd, cfg)
 		if err != nil {
-			return nil, cobra.ShellCompDirectiveNoFileComp
+			return err
 		}
-		var completions []string
-		for _, entry := range entries {
-			if !entry.IsDir() {
-				continue
-			}
-			name := entry.Name()
-			if len(toComplete) == 0 || strings.HasPrefix(name, toComplete) {
-				completions = append(completions, name)
-			}
+		defer imageDirLock.Release()
+		store := imagestore.New(cfg.ImageDir)
+		imageRef, err := artifact.ParseReference(args[0])
+		if err != nil {
+			return err
+		}
+		if imageRef.Constraint != "" {
+			return fmt.Errorf("image %s has a version constraint, please specify the tag or digest of the image to remove", imageRef)
+		}
+		imagePath, found := store.Lookup(imageRef)
+		if !found {
+			fmt.Fprintf(cmd.ErrOrStderr(), "Image %s does not exist locally, skipping removal.\n", args[0])
+			return nil
+		}
+		img, err := store.ImageFromDir(imagePath)
+		if err != nil {
+			return err
 		}
-		return completions, cobra.ShellCompDirectiveNoFileComp
+		if err := store.Remove(img); err != nil {
+			return fmt.Errorf("failed to remove image directory: %w", err)
+		}
+		// Release the cached blobs which are no longer used by any image
+		if err := store.GC(cmd.Context()); err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.ErrOrStderr(), "Image %s removed (%s)\n", img, img.Dir)
+		return nil
 	},
+}
+
+var pruneImagesCmd = &cobra.Command{
+	Use:     "prune",
+	Short:   "Remove cached image blobs which are no longer used by any image",
+	Example: `tedge-oscar flows images prune`,
+	Args:    cobra.NoArgs,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		cfgPath := configPath
 		if cfgPath == "" {
@@ -54,20 +79,19 @@ var removeImageCmd = &cobra.Command{
 		if err != nil {
 			return err
 		}
-		imageDir := cfg.ImageDir
-		if imageDir == "" {
+		if cfg.ImageDir == "" {
 			return fmt.Errorf("image_dir not set in config")
 		}
-		folderName := args[0]
-		fullPath := filepath.Join(imageDir, folderName)
-		if _, err := os.Stat(fullPath); os.IsNotExist(err) {
-			fmt.Fprintf(cmd.ErrOrStderr(), "Image folder %s does not exist locally, skipping removal.\n", folderName)
-			return nil
+		imageDirLock, err := lockImageDir(cmd, cfg)
+		if err != nil {
+			return err
 		}
-		if err := os.RemoveAll(fullPath); err != nil {
-			return fmt.Errorf("failed to remove image directory: %w", err)
+		defer imageDirLock.Release()
+		store := imagestore.New(cfg.ImageDir)
+		if err := store.GC(cmd.Context()); err != nil {
+			return err
 		}
-		fmt.Fprintf(cmd.ErrOrStderr(), "Image folder %s removed (%s)\n", folderName, fullPath)
+		fmt.Fprintf(cmd.ErrOrStderr(), "Image cache pruned (%s)\n", filepath.Join(cfg.ImageDir, imagestore.CacheDir))
 		return nil
 	},
 }
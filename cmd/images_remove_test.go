@@ -0,0 +1,30 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRemoveImageRejectsConstraint(t *testing.T) {
+	env := newTestEnv(t)
+	tarball := filepath.Join(t.TempDir(), "counter:latest.tar")
+	writeTarball(t, tarball, map[string]string{
+		"flow.toml":   testFlow,
+		"lib/main.js": "// latest",
+	})
+	if _, err := env.run(t, "flows", "images", "load", tarball); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"flows", "images", "remove", "counter:^1"},
+		{"flows", "images", "inspect", "counter:^1"},
+	} {
+		if _, err := env.run(t, args...); err == nil {
+			t.Errorf("expected %v to fail for a version constraint", args)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(env.ImageDir, "local", "counter", "latest")); err != nil {
+		t.Fatalf("image was removed: %v", err)
+	}
+}
@@ -0,0 +1,181 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/thin-edge/tedge-oscar/internal/artifact"
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/imageinspect"
+	"github.com/thin-edge/tedge-oscar/internal/imagestore"
+	"github.com/thin-edge/tedge-oscar/internal/registryauth"
+)
+
+var inspectImageCmd = &cobra.Command{
+	Use:   "inspect [image]",
+	Short: "Show the manifest, annotations, files and config of a flow image",
+	Long: `Show the manifest, annotations, files and config of a flow image.
+Images which have been pulled are inspected using their stored manifest, otherwise the
+manifest is fetched from the registry without pulling the image.`,
+	Example: `# Inspect an image in the registry
+$ tedge-oscar flows images inspect ghcr.io/thin-edge/connectivity-counter:1.0 --remote
+
+# Inspect a pulled image as JSON
+$ tedge-oscar flows images inspect ghcr.io/thin-edge/connectivity-counter:1.0 -o json`,
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true, // Do not show help on runtime errors
+	ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		if len(args) != 0 {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		return completeImageVersions(cmd, toComplete)
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		registryauth.SetDebugHTTP(logLevel)
+		outputFormat, err := cmd.Flags().GetString("output")
+		if err != nil {
+			return err
+		}
+		remote, err := cmd.Flags().GetBool("remote")
+		if err != nil {
+			return err
+		}
+		cfgPath := configPath
+		if cfgPath == "" {
+			cfgPath = config.DefaultConfigPath()
+		}
+		cfg, err := config.LoadConfig(cfgPath)
+		if err != nil {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
+		imageRef, err := artifact.ParseReference(args[0])
+		if err != nil {
+			return err
+		}
+		if imageRef.Constraint != "" {
+			return fmt.Errorf("image %s has a version constraint, please specify the tag or digest of the image to inspect", imageRef)
+		}
+
+		var info *imageinspect.Info
+		if !remote && cfg.ImageDir != "" {
+			store := imagestore.New(cfg.ImageDir)
+			if imagePath, found := store.Lookup(imageRef); found {
+				img, err := store.ImageFromDir(imagePath)
+				if err != nil {
+					return err
+				}
+				if info, err = imageinspect.Local(cmd.Context(), store, img); err != nil {
+					return err
+				}
+			}
+		}
+		if info == nil {
+			if imageRef.Registry == artifact.LocalRegistry {
+				return fmt.Errorf("image %s does not exist locally", imageRef)
+			}
+			if imageRef.Reference() == "" {
+				return fmt.Errorf("image reference must include a tag or digest, e.g. ghcr.io/user/repo:tag or @sha256:<hash>")
+			}
+			repo, err := registryauth.NewRepository(cfg, imageRef)
+			if err != nil {
+				return err
+			}
+			if info, err = imageinspect.Remote(cmd.Context(), repo, imageRef.Reference(), imageRef.String()); err != nil {
+				return err
+			}
+		}
+
+		if outputFormat == "json" {
+			enc := json.NewEncoder(cmd.OutOrStdout())
+			enc.SetEscapeHTML(false)
+			enc.SetIndent("", "  ")
+			return enc.Encode(info)
+		}
+		return printImageInfo(cmd.OutOrStdout(), info)
+	},
+}
+
+// printImageInfo writes the human-readable view of an inspected image
+func printImageInfo(out io.Writer, info *imageinspect.Info) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Reference:\t%s\n", info.Reference)
+	fmt.Fprintf(w, "Location:\t%s\n", info.Location)
+	if info.Path != "" {
+		fmt.Fprintf(w, "Path:\t%s\n", info.Path)
+	}
+	if info.NoManifest {
+		fmt.Fprintln(w, "Manifest:\tnot stored (only the files of the image are known)")
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "Files:")
+		w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "  NAME\tSIZE")
+		for _, file := range info.Files {
+			fmt.Fprintf(w, "  %s\t%d\n", file.Name, file.Size)
+		}
+		return w.Flush()
+	}
+	fmt.Fprintf(w, "Digest:\t%s\n", info.Digest)
+	fmt.Fprintf(w, "Media type:\t%s\n", info.MediaType)
+	if info.ArtifactType != "" {
+		fmt.Fprintf(w, "Artifact type:\t%s\n", info.ArtifactType)
+	}
+	if len(info.Annotations) > 0 {
+		fmt.Fprintln(w, "Annotations:")
+		keys := make([]string, 0, len(info.Annotations))
+		for k := range info.Annotations {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(w, "  %s:\t%s\n", k, info.Annotations[k])
+		}
+	}
+	if info.Config != nil {
+		fmt.Fprintln(w, "Config:")
+		fmt.Fprintf(w, "  Media type:\t%s\n", info.Config.MediaType)
+		fmt.Fprintf(w, "  Digest:\t%s\n", info.Config.Digest)
+		fmt.Fprintf(w, "  Size:\t%d\n", info.Config.Size)
+		if len(info.Config.Data) > 0 {
+			fmt.Fprintf(w, "  Data:\t%s\n", info.Config.Data)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if len(info.Layers) > 0 {
+		fmt.Fprintln(out, "Layers:")
+		w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "  TITLE\tSIZE\tDIGEST\tMEDIA TYPE")
+		for _, layer := range info.Layers {
+			fmt.Fprintf(w, "  %s\t%d\t%s\t%s\n", layer.Title, layer.Size, layer.Digest, layer.MediaType)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	if len(info.Manifests) > 0 {
+		fmt.Fprintln(out, "Manifests:")
+		w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "  DIGEST\tSIZE\tMEDIA TYPE")
+		for _, m := range info.Manifests {
+			fmt.Fprintf(w, "  %s\t%d\t%s\n", m.Digest, m.Size, m.MediaType)
+		}
+		return w.Flush()
+	}
+	return nil
+}
+
+func init() {
+	inspectImageCmd.Flags().StringP("output", "o", "text", "Output format: text|json")
+	inspectImageCmd.Flags().Bool("remote", false, "Inspect the image in the registry even if it has been pulled")
+	_ = inspectImageCmd.RegisterFlagCompletionFunc("output", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{"text", "json"}, cobra.ShellCompDirectiveNoFileComp
+	})
+	imagesCmd.AddCommand(inspectImageCmd)
+}
@@ -1,23 +1,29 @@
 package cmd
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
-	"github.com/olekukonko/tablewriter"
 	"github.com/spf13/cobra"
 	"github.com/thin-edge/tedge-oscar/internal/artifact"
 	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/history"
 	"github.com/thin-edge/tedge-oscar/internal/imagepull"
+	"github.com/thin-edge/tedge-oscar/internal/imagestore"
+	"github.com/thin-edge/tedge-oscar/internal/lock"
+	"github.com/thin-edge/tedge-oscar/internal/lockfile"
+	"github.com/thin-edge/tedge-oscar/internal/params"
 	"github.com/thin-edge/tedge-oscar/internal/util"
 	"github.com/thin-edge/tedge-oscar/pkg/maputil"
 	"github.com/thin-edge/tedge-oscar/pkg/types/flows"
-	"golang.org/x/term"
 )
 
 var instancesCmd = &cobra.Command{
@@ -34,6 +40,65 @@ $ tedge-oscar flows instances remove myinstance
 `,
 }
 
+// instance is a flow instance deployed to a deploy_dir
+type instance struct {
+	Name string
+	// Path is the path of the instance file
+	Path string
+	// Layout is the layout used to deploy the instance (config.LayoutFile or config.LayoutDir)
+	Layout string
+	File   flows.InstanceFile
+	// Err is set if the instance file can not be parsed
+	Err error
+	// Image is the image of the instance, or nil if it can not be determined
+	Image *imagestore.Image
+	// Entry is the lockfile entry of the instance, or nil if it has none
+	Entry *lockfile.Entry
+}
+
+// readInstances returns the instances deployed to deployDir. The image of an instance using the file layout
+// is resolved from the first script of its steps, e.g. <image_dir>/ghcr.io/thin-edge/counter/1.0/lib/main.js,
+// while the image of an instance using the dir layout is the one recorded in the lockfile (if still available).
+// The lockfile entry of each instance is returned as well.
+func readInstances(store *imagestore.Store, deployDir string) ([]instance, error) {
+	instances, err := findInstances(deployDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read deploy dir: %w", err)
+	}
+	lf, err := lockfile.Load(deployDir)
+	if err != nil {
+		slog.Warn("Failed to read the lockfile", "error", err)
+		lf = &lockfile.File{}
+	}
+	for i := range instances {
+		inst := &instances[i]
+		if entry, ok := lf.Instances[inst.Name]; ok {
+			inst.Entry = &entry
+		}
+		if _, err := toml.DecodeFile(inst.Path, &inst.File); err != nil {
+			inst.Err = err
+		} else if len(inst.File.Steps) == 0 {
+			inst.Err = fmt.Errorf("instance has no steps")
+		} else if inst.Layout == config.LayoutDir {
+			if inst.Entry != nil {
+				if ref, err := artifact.ParseReference(inst.Entry.Image); err == nil {
+					if dir, found := store.Lookup(ref); found {
+						if img, err := store.ImageFromDir(dir); err == nil {
+							inst.Image = &img
+						}
+					}
+				}
+			}
+		} else if img, err := store.FindImage(inst.File.Script()); err == nil {
+			inst.Image = &img
+		}
+	}
+	return instances, nil
+}
+
 var listInstancesCmd = &cobra.Command{
 	Use:     "list",
 	Short:   "List deployed flow instances",
@@ -54,7 +119,7 @@ $ tedge-oscar flows instances list`,
 		if selectCols != "" {
 			colNames = strings.Split(selectCols, ",")
 		} else {
-			colNames = []string{"name", "path", "topics", "image", "imageVersion"}
+			colNames = []string{"name", "path", "topics", "image", "imageVersion", "digest", "deployedAt"}
 		}
 
 		cfgPath := configPath
@@ -74,85 +139,62 @@ $ tedge-oscar flows instances list`,
 			return fmt.Errorf("failed to evaluate deployDir: %w", err)
 		}
 		slog.Info("Reading deployDir", "path", deployDir)
-		files, err := os.ReadDir(deployDir)
-		if err != nil {
-			if os.IsNotExist(err) {
-				files = []os.DirEntry{}
-			} else {
-				return fmt.Errorf("failed to read deploy dir: %w", err)
-			}
-		}
 		// Use the unexpanded deployDir from config for display
 		unexpandedDeployDir := cfg.UnexpandedDeployDir
 		if unexpandedDeployDir == "" {
 			unexpandedDeployDir = "$DEPLOY_DIR"
 		}
-		// Get the unexpanded image_dir from the config for display
-		unexpandedImageDir := cfg.UnexpandedImageDir
-		if unexpandedImageDir == "" {
-			unexpandedImageDir = "$IMAGE_DIR"
+		store := imagestore.New(cfg.ImageDir)
+		instances, err := readInstances(store, deployDir)
+		if err != nil {
+			return err
+		}
+		lf, err := lockfile.Load(deployDir)
+		if err != nil {
+			slog.Warn("Failed to read the lockfile", "error", err)
+			lf = &lockfile.File{}
 		}
 		// Prepare all rows first
 		rows := [][]string{}
-		for _, file := range files {
-			if file.IsDir() || !strings.HasSuffix(file.Name(), ".toml") {
-				continue
-			}
-			name := strings.TrimSuffix(file.Name(), ".toml")
-			path := filepath.Join(unexpandedDeployDir, file.Name())
-			var data flows.InstanceFile
+		for _, inst := range instances {
 			topics := ""
-			image := "<invalid>"
+			imageName := "<invalid>"
 			imageVersion := "<unknown>"
-			if _, err := toml.DecodeFile(filepath.Join(deployDir, file.Name()), &data); err == nil && len(data.Steps) > 0 {
-				topics = strings.Join(data.Input.MQTT.Topics, ", ")
-				// If the image path starts with the expanded imageDir, replace with unexpanded
-				imgPath := data.Steps[0].Script
-				if strings.HasPrefix(imgPath, cfg.ImageDir) && unexpandedImageDir != "" {
-					rel, err := filepath.Rel(cfg.ImageDir, imgPath)
-					if err == nil {
-						imgPath = filepath.Join(unexpandedImageDir, rel)
-					}
-				}
-				image = imgPath
-				// Try to get image version from manifest.json
-				manifestPath := ""
-				if strings.HasPrefix(data.Steps[0].Script, cfg.ImageDir) {
-					// e.g. /Users/you/.tedge/images/imagename/lib/main.js
-					imgDir := filepath.Dir(filepath.Dir(data.Steps[0].Script))
-					manifestPath = filepath.Join(imgDir, "manifest.json")
-				}
-				if manifestPath != "" {
-					if f, err := os.Open(manifestPath); err == nil {
-						var manifest map[string]interface{}
-						if err := json.NewDecoder(f).Decode(&manifest); err == nil {
-							if ann, ok := manifest["annotations"].(map[string]interface{}); ok {
-								if v, ok := ann["org.opencontainers.image.version"].(string); ok {
-									imageVersion = v
-								}
-							}
-						}
-						f.Close()
+			if inst.Err == nil {
+				topics = strings.Join(inst.File.Input.MQTT.Topics, ", ")
+				if inst.Image != nil {
+					imageName = inst.Image.Name()
+					imageVersion = storedImageVersion(*inst.Image)
+				} else if inst.Layout == config.LayoutDir {
+					// e.g. a flow installed by the sm-plugin, which only has the version of its flow definition
+					imageName = "<none>"
+					if inst.File.Version != "" {
+						imageVersion = inst.File.Version
 					}
 				}
 			}
-			// Only show the image name (not the path)
-			imageName := "<invalid>"
-			if image != "<invalid>" {
-				// Try to extract the image directory name from the path
-				imgDir := filepath.Base(filepath.Dir(filepath.Dir(data.Steps[0].Script)))
-				if imgDir != "." && imgDir != "/" && imgDir != "" {
-					imageName = artifact.TrimVersion(imgDir)
-				}
+			path := inst.Path
+			if rel, err := filepath.Rel(deployDir, inst.Path); err == nil {
+				path = filepath.Join(unexpandedDeployDir, rel)
 			}
 			// Build row based on selected columns
 			rowMap := map[string]string{
-				"name":         name,
+				"name":         inst.Name,
 				"path":         path,
+				"layout":       inst.Layout,
 				"topics":       topics,
 				"image":        imageName,
 				"imageVersion": imageVersion,
 			}
+			// Instances deployed before the lockfile was introduced have no entry
+			if entry, ok := lf.Instances[inst.Name]; ok {
+				rowMap["digest"] = entry.Digest
+				rowMap["reference"] = entry.Image
+				rowMap["requested"] = entry.Requested
+				rowMap["source"] = entry.Source
+				rowMap["pinned"] = strconv.FormatBool(entry.Pinned)
+				rowMap["deployedAt"] = entry.DeployedAt.Format(time.RFC3339)
+			}
 			row := make([]string, len(colNames))
 			for i, col := range colNames {
 				row[i] = rowMap[col]
@@ -163,70 +205,81 @@ $ tedge-oscar flows instances list`,
 			fmt.Fprintln(cmd.ErrOrStderr(), "No flow instances are currently deployed.")
 			return nil
 		}
-		if outputFormat == "jsonl" || outputFormat == "json" {
-			for _, row := range rows {
-				obj := map[string]string{}
-				for i, col := range colNames {
-					obj[col] = row[i]
-				}
-				enc := json.NewEncoder(cmd.OutOrStdout())
-				enc.SetEscapeHTML(false)
-				_ = enc.Encode(obj)
-			}
-			return nil
-		}
-		if outputFormat == "tsv" {
-			for _, row := range rows {
-				fmt.Fprintln(cmd.OutOrStdout(), strings.Join(row, "\t"))
-			}
-			return nil
+		return renderRows(cmd.OutOrStdout(), outputFormat, colNames, rows)
+	},
+}
+
+// ensureImage resolves the version constraint of an image and makes sure that the image is available locally,
+// pulling it according to the pull policy. It returns the resolved reference and the folder of the image. An image loaded
+// from a tarball is returned using the reference of its folder, e.g. local/counter:1.0 for counter:1.0.
+func ensureImage(cmd *cobra.Command, cfg *config.Config, store *imagestore.Store, imageRef artifact.Reference, pullPolicy string) (artifact.Reference, string, error) {
+	if imageRef.Constraint != "" {
+		var resolved artifact.Reference
+		var err error
+		if pullPolicy == config.PullNever {
+			resolved, err = resolveLocalImageVersion(cmd, store, imageRef)
+		} else if resolved, err = resolveImageVersion(cmd, cfg, imageRef); err != nil && pullPolicy == config.PullIfNotPresent {
+			// e.g. the registry is not reachable
+			slog.Warn("Could not resolve the version using the registry, using the local images instead", "error", err)
+			resolved, err = resolveLocalImageVersion(cmd, store, imageRef)
 		}
-		// Determine which columns fit in one row
-		maxWidth := 0
-		tablePadding := 2 // left + right border
-		columnPadding := 2
-		if w, _, err := terminalSize(); err == nil {
-			maxWidth = w - tablePadding
-		} else {
-			maxWidth = 120 // fallback
+		if err != nil {
+			return imageRef, "", err
 		}
-		colWidths := make([]int, len(colNames))
-		for i := range colNames {
-			colWidths[i] = len(colNames[i]) + columnPadding
+		imageRef = resolved
+	}
+
+	imagePath, found := store.Lookup(imageRef)
+	complete := found && imagestore.IsComplete(imagePath)
+	var loaded *imagestore.Image
+	if img, err := store.ImageFromDir(imagePath); found && err == nil && img.Reference.Registry == artifact.LocalRegistry {
+		loaded = &img
+	}
+	switch {
+	case loaded != nil && !complete:
+		// e.g. the folder of an image written by an interrupted load
+		return imageRef, "", fmt.Errorf("image %s is incomplete, load it again. path=%s", imageRef, imagePath)
+	case loaded != nil:
+		// Images loaded from a tarball can not be pulled. The image is referred to by its folder (e.g. local/counter:1.0),
+		// as a reference without a registry (e.g. counter:1.0) would be pulled from Docker Hub later on
+		return loaded.Reference, imagePath, nil
+	case pullPolicy == config.PullNever:
+		if !found {
+			return imageRef, "", fmt.Errorf("image %s not found locally and the pull policy is %s", imageRef, config.PullNever)
+		}
+		if !complete {
+			return imageRef, "", fmt.Errorf("image %s is incomplete and the pull policy is %s. path=%s", imageRef, config.PullNever, imagePath)
+		}
+		return imageRef, imagePath, nil
+	case !found:
+		fmt.Fprintf(cmd.ErrOrStderr(), "Image %s not found locally. Pulling...\n", imageRef)
+	case !complete:
+		// e.g. the folder of an image written by an interrupted pull of an older version
+		fmt.Fprintf(cmd.ErrOrStderr(), "Image %s is incomplete. Pulling...\n", imageRef)
+	case pullPolicy == config.PullAlways && imageRef.Digest == "":
+		// Tags are mutable, so compare the digest of the local image with the registry
+		remoteDigest, err := imagepull.ResolveDigest(cmd.Context(), cfg, imageRef)
+		if err != nil {
+			return imageRef, "", err
 		}
-		for _, row := range rows {
-			for i, cell := range row {
-				if l := len(cell); l > colWidths[i] {
-					colWidths[i] = l + columnPadding
-				}
-			}
+		localDigest := imagestore.ReadAnnotation(imagePath, imagestore.AnnotationDigest)
+		if localDigest == remoteDigest {
+			fmt.Fprintf(cmd.ErrOrStderr(), "Image %s is up to date (digest: %s)\n", imageRef, localDigest)
+			return imageRef, imagePath, nil
 		}
-		total := len(colNames) - 1 // for separators
-		for _, w := range colWidths {
-			total += w
-		}
-		// Remove columns from right until fits
-		keep := len(colNames)
-		for total > maxWidth && keep > 1 {
-			keep--
-			total -= (colWidths[keep] + 1)
-		}
-		// Prepare filtered columns
-		filteredColNames := colNames[:keep]
-		filteredRows := [][]string{}
-		for _, row := range rows {
-			filteredRows = append(filteredRows, row[:keep])
-		}
-		colHeaders := make([]any, len(filteredColNames))
-		for i, v := range filteredColNames {
-			colHeaders[i] = v
-		}
-		table := tablewriter.NewTable(cmd.OutOrStdout())
-		table.Header(colHeaders...)
-		table.Bulk(filteredRows)
-		table.Render()
-		return nil
-	},
+		fmt.Fprintf(cmd.ErrOrStderr(), "Image %s has changed (local digest: %s, registry digest: %s). Pulling...\n", imageRef, localDigest, remoteDigest)
+	default:
+		return imageRef, imagePath, nil
+	}
+
+	// Images matching a tarball image by name are pulled into their own folder
+	imagePath = store.Path(imageRef)
+	result, err := imagepull.PullImage(cmd.Context(), cfg, imageRef, imagePath, "", false)
+	if err != nil {
+		return imageRef, "", fmt.Errorf("failed to pull image: %w", err)
+	}
+	fmt.Fprintf(cmd.ErrOrStderr(), "Image %s pulled (source: %s, digest: %s)\n", imageRef, result.Source.Name(), result.Digest)
+	return imageRef, imagePath, nil
 }
 
 var deployCmd = &cobra.Command{
@@ -234,7 +287,16 @@ var deployCmd = &cobra.Command{
 	Short:   "Deploy a flow instance",
 	Aliases: []string{"run"},
 	Example: `# Deploy a new instance using a specific image and topic
-$ tedge-oscar flows instances deploy myinstance ghcr.io/thin-edge/connectivity-counter:1.0 --topics te/device/main///m/+`,
+$ tedge-oscar flows instances deploy myinstance ghcr.io/thin-edge/connectivity-counter:1.0 --topics te/device/main///m/+
+
+# Deploy the highest 1.x version available in the registry
+$ tedge-oscar flows instances deploy myinstance "ghcr.io/thin-edge/connectivity-counter:^1" --topics te/device/main///m/+
+
+# Redeploy a mutable tag, pulling the image if the tag now points to a different digest
+$ tedge-oscar flows instances deploy myinstance ghcr.io/thin-edge/connectivity-counter:latest --pull always
+
+# Deploy a self-contained copy of the image to <deploy_dir>/myinstance/flow.toml (as done by the flow sm-plugin)
+$ tedge-oscar flows instances deploy myinstance ghcr.io/thin-edge/connectivity-counter:1.0 --layout dir`,
 	Args:         cobra.ExactArgs(2),
 	SilenceUsage: true, // Do not show help on runtime errors
 	ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
@@ -242,33 +304,7 @@ $ tedge-oscar flows instances deploy myinstance ghcr.io/thin-edge/connectivity-c
 		if len(args) != 1 {
 			return nil, cobra.ShellCompDirectiveNoFileComp
 		}
-		cfgPath := configPath
-		if cfgPath == "" {
-			cfgPath = config.DefaultConfigPath()
-		}
-		cfg, err := config.LoadConfig(cfgPath)
-		if err != nil {
-			return nil, cobra.ShellCompDirectiveNoFileComp
-		}
-		imageDir := cfg.ImageDir
-		if imageDir == "" {
-			return nil, cobra.ShellCompDirectiveNoFileComp
-		}
-		entries, err := os.ReadDir(imageDir)
-		if err != nil {
-			return nil, cobra.ShellCompDirectiveNoFileComp
-		}
-		var completions []string
-		for _, entry := range entries {
-			if !entry.IsDir() {
-				continue
-			}
-			name := entry.Name()
-			if strings.HasPrefix(name, toComplete) {
-				completions = append(completions, name)
-			}
-		}
-		return completions, cobra.ShellCompDirectiveNoFileComp
+		return completeImageVersions(cmd, toComplete)
 	},
 	RunE: func(cmd *cobra.Command, args []string) error {
 		cfgPath := configPath
@@ -281,7 +317,10 @@ $ tedge-oscar flows instances deploy myinstance ghcr.io/thin-edge/connectivity-c
 		}
 
 		instanceName := args[0]
-		imageRef := args[1]
+		imageRef, err := artifact.ParseReference(args[1])
+		if err != nil {
+			return err
+		}
 		topics, err := cmd.Flags().GetStringArray("topics")
 		if err != nil {
 			return err
@@ -292,10 +331,32 @@ $ tedge-oscar flows instances deploy myinstance ghcr.io/thin-edge/connectivity-c
 			mapper = v
 		}
 
+		pin, err := cmd.Flags().GetBool("pin")
+		if err != nil {
+			return err
+		}
+		pullPolicy := cfg.PullPolicy
+		if cmd.Flags().Changed("pull") {
+			pullPolicy, _ = cmd.Flags().GetString("pull")
+			if err := config.ValidatePullPolicy(pullPolicy); err != nil {
+				return err
+			}
+		}
 		interval := ""
 		if cmd.Flags().Changed("interval") {
 			interval, _ = cmd.Flags().GetString("interval")
 		}
+		layout := cfg.DeployLayout
+		if cmd.Flags().Changed("layout") {
+			layout, _ = cmd.Flags().GetString("layout")
+			if err := config.ValidateDeployLayout(layout); err != nil {
+				return err
+			}
+		}
+		// The mapper only reads the params.toml of a flow from the folder of the flow
+		if layout == config.LayoutFile && (cmd.Flags().Changed("param") || cmd.Flags().Changed("params-file")) {
+			return fmt.Errorf("params are only supported by the %s layout, use --layout %s", config.LayoutDir, config.LayoutDir)
+		}
 		deployDir, err := cfg.GetDeployDir(mapper)
 		if err != nil {
 			return fmt.Errorf("failed to evaluate deployDir: %w", err)
@@ -303,169 +364,239 @@ $ tedge-oscar flows instances deploy myinstance ghcr.io/thin-edge/connectivity-c
 		if err := os.MkdirAll(deployDir, 0755); err != nil {
 			return err
 		}
-
-		// Extract repository part from image reference (remove tag/digest)
-		name, err := artifact.ParseName(imageRef, false)
+		deployDirLock, err := lockDeployDir(cmd, deployDir)
 		if err != nil {
 			return err
 		}
-
-		imagePath := filepath.Join(cfg.ImageDir, name)
-		scriptPath := filepath.Join(imagePath, "lib/main.js")
-		fmt.Fprintf(cmd.ErrOrStderr(), "script path: %s\n", scriptPath)
-
-		if _, err := os.Stat(imagePath); os.IsNotExist(err) {
-			fmt.Fprintf(cmd.ErrOrStderr(), "Image %s not found locally. Pulling...\n", imageRef)
-			if err := imagepull.PullImage(cfg, imageRef, cfg.ImageDir, "", false); err != nil {
-				return fmt.Errorf("failed to pull image: %w", err)
-			}
+		defer deployDirLock.Release()
+		// An instance can only be deployed using one layout at a time
+		if _, existing, err := findInstance(deployDir, instanceName); err == nil && existing != layout {
+			return fmt.Errorf("instance %s is already deployed using the %s layout, remove it before deploying it using the %s layout", instanceName, existing, layout)
 		}
 
-		if _, err := os.Stat(scriptPath); os.IsNotExist(err) {
-			fmt.Fprintf(cmd.ErrOrStderr(), "Image %s does not contain the expected entrypoint. path=%s\n", imageRef, scriptPath)
+		// The image_dir is locked while checking for, pulling and reading the image
+		imageDirLock, err := lockImageDir(cmd, cfg)
+		if err != nil {
 			return err
 		}
-
-		tomlPath := filepath.Join(deployDir, instanceName+".toml")
-		// Look for the first existing TOML config file in priority order
-		var imageFlowDefinitionPath string
-		for _, candidate := range []string{"flow.toml", "pipeline.toml"} {
-			candidatePath := filepath.Join(imagePath, candidate)
-			if _, err := os.Stat(candidatePath); err == nil {
-				imageFlowDefinitionPath = candidatePath
-				break
-			}
+		defer imageDirLock.Release()
+		store := imagestore.New(cfg.ImageDir)
+		requestedRef := imageRef
+		imageRef, imagePath, err := ensureImage(cmd, cfg, store, imageRef, pullPolicy)
+		if err != nil {
+			return err
 		}
-		if _, err := os.Stat(imageFlowDefinitionPath); err == nil {
-			// Load flow definition as a map to preserve all fields
-			var m map[string]interface{}
-			if _, err := toml.DecodeFile(imageFlowDefinitionPath, &m); err != nil {
-				return fmt.Errorf("failed to parse %s: %w", imageFlowDefinitionPath, err)
-			}
-			// Always update topics from CLI using a helper to set nested keys
-			if len(topics) > 0 {
-				if err := maputil.SetNestedMapValue(m, []string{"input", "mqtt", "topics"}, topics); err != nil {
-					return fmt.Errorf("failed to set input.mqtt.topics: %w", err)
-				}
-			}
-			// If interval is set, update all steps with the interval value
-			if stepsRaw, ok := m["steps"]; ok {
-				var newSteps []map[string]interface{}
-				switch steps := stepsRaw.(type) {
-				case []map[string]interface{}:
-					newSteps = make([]map[string]interface{}, len(steps))
-					for i, stepMap := range steps {
-						stepMap["script"] = scriptPath
-						if interval != "" {
-							stepMap["interval"] = interval
-						}
-						newSteps[i] = stepMap
-					}
-				case []interface{}:
-					newSteps = make([]map[string]interface{}, len(steps))
-					for i, s := range steps {
-						if stageMap, ok := s.(map[string]interface{}); ok {
-							stageMap["script"] = scriptPath
-							if interval != "" {
-								stageMap["interval"] = interval
-							}
-							newSteps[i] = stageMap
-						}
-					}
-				}
-				m["steps"] = newSteps
+		if pin {
+			img, err := store.ImageFromDir(imagePath)
+			if err != nil {
+				return err
 			}
-			f, err := os.Create(tomlPath)
+			pinned, err := store.Pin(cmd.Context(), img)
 			if err != nil {
+				return fmt.Errorf("failed to pin image: %w", err)
+			}
+			imageRef.Digest = pinned.Reference.Digest
+			imagePath = pinned.Dir
+			fmt.Fprintf(cmd.ErrOrStderr(), "Pinned %s (path: %s)\n", imageRef, imagePath)
+		}
+		imageDigest := imagestore.ReadAnnotation(imagePath, imagestore.AnnotationDigest)
+		if requestedRef.Constraint != "" {
+			fmt.Fprintf(cmd.ErrOrStderr(), "Using %s (digest: %s) for version constraint %s\n", imageRef, imageDigest, requestedRef.Constraint)
+		}
+		entry := lockfile.Entry{
+			Image:      imageRef.String(),
+			Requested:  requestedRef.String(),
+			Digest:     imageDigest,
+			Source:     imagestore.ReadAnnotation(imagePath, imagestore.AnnotationSource),
+			Pinned:     pin,
+			DeployedAt: time.Now().UTC().Truncate(time.Second),
+		}
+
+		data, err := renderInstance(imagePath, topics, interval)
+		if err != nil {
+			return fmt.Errorf("failed to render instance from image %s: %w", imageRef, err)
+		}
+		if _, ok := lookupValue(data, "input", "mqtt", "topics"); !ok && isInteractive(cmd) {
+			if topics, err = promptTopics(cmd); err != nil {
 				return err
 			}
-			defer f.Close()
-			if err := toml.NewEncoder(f).Encode(m); err != nil {
+			if err := overrideInstance(data, topics, ""); err != nil {
 				return err
 			}
-			fmt.Fprintf(cmd.ErrOrStderr(), "Instance %s deployed at %s\n", instanceName, tomlPath)
-			return nil
-		} else {
-			// Fallback: create minimal config
-			var intervalPtr *string
-			if interval != "" {
-				intervalPtr = &interval
+		}
+		// The given params are merged into the params of the instance, which are kept across deployments
+		schema, template, err := loadImageParams(imagePath)
+		if err != nil {
+			return err
+		}
+		if schema != nil {
+			entry.Secrets = schema.Secrets()
+		}
+		var instanceParams map[string]any
+		if layout == config.LayoutFile {
+			if template != nil {
+				slog.Warn("The image has params, which are only used by instances deployed using the dir layout", "image", imageRef, "layout", layout)
 			}
-			data := map[string]interface{}{
-				"steps": []map[string]interface{}{
-					{
-						"script":   scriptPath,
-						"interval": intervalPtr,
-					},
-				},
+		} else if instanceParams, err = readParamFlags(cmd, schema, template); err != nil {
+			return err
+		} else if instanceParams != nil || template != nil {
+			existing, err := params.Load(paramsPath(deployDir, instanceName))
+			if err != nil {
+				return err
 			}
-			if len(topics) > 0 {
-				if err := maputil.SetNestedMapValue(data, []string{"input", "mqtt", "topics"}, topics); err != nil {
-					return fmt.Errorf("failed to set input.mqtt.topics: %w", err)
+			changed := instanceParams != nil
+			maputil.Merge(existing, instanceParams)
+			if schema != nil {
+				completed, err := completeRequiredParams(cmd, schema, existing)
+				if err != nil {
+					return err
 				}
+				changed = changed || completed
 			}
-			f, err := os.Create(tomlPath)
-			if err != nil {
+			// The params kept from a previous deployment may no longer match the params of the image
+			if err := validateParams(existing, schema, template); err != nil {
+				return fmt.Errorf("invalid params of instance %s, update them using --param or in %s: %w", instanceName, paramsPath(deployDir, instanceName), err)
+			}
+			instanceParams = nil
+			if changed {
+				instanceParams = existing
+			}
+		}
+		var tomlPath string
+		if layout == config.LayoutDir {
+			// The image files are copied while the image_dir is still locked. The history records the instance
+			// with scripts relative to its folder, and the files are copied again from the image of the revision.
+			if tomlPath, err = deployInstanceDir(cmd.Context(), deployDir, instanceName, imagePath, data, instanceParams); err != nil {
 				return err
 			}
-			defer f.Close()
-			if err := toml.NewEncoder(f).Encode(data); err != nil {
+		} else {
+			tomlPath = filepath.Join(deployDir, instanceName+".toml")
+			if err := writeInstanceFile(cmd.Context(), tomlPath, data); err != nil {
 				return err
 			}
-			fmt.Fprintf(cmd.ErrOrStderr(), "Instance %s deployed at %s\n", instanceName, tomlPath)
-			return nil
 		}
+		if err := imageDirLock.Release(); err != nil {
+			return err
+		}
+		if err := recordInstance(cfg, deployDir, instanceName, entry, data); err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.ErrOrStderr(), "Instance %s deployed at %s\n", instanceName, tomlPath)
+		return nil
 	},
 }
 
-var removeInstanceCmd = &cobra.Command{
-	Use:     "remove [instance_name]",
-	Short:   "Remove a deployed flow instance",
-	Aliases: []string{"rm"},
-	Example: `# Remove a deployed instance
-$ tedge-oscar flows instances remove myinstance`,
-	Args:         cobra.ExactArgs(1),
-	SilenceUsage: true, // Do not show help on runtime errors
-	ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
-		cfgPath := configPath
-		if cfgPath == "" {
-			cfgPath = config.DefaultConfigPath()
-		}
-		cfg, err := config.LoadConfig(cfgPath)
-		if err != nil {
-			return nil, cobra.ShellCompDirectiveNoFileComp
-		}
-		mapper := "local"
-		if v, err := cmd.Flags().GetString("mapper"); err == nil {
-			mapper = v
-		}
-		deployDir, err := cfg.GetDeployDir(mapper)
-		if err != nil {
-			return nil, cobra.ShellCompDirectiveNoFileComp
-		}
-		entries, err := os.ReadDir(deployDir)
-		if err != nil {
-			return nil, cobra.ShellCompDirectiveNoFileComp
-		}
-		var completions []string
-		provided := make(map[string]struct{})
-		for _, arg := range args {
-			provided[arg] = struct{}{}
+// renderInstance returns the instance file of an image, based on the flow definition of the image (if any).
+// The script of every step is resolved relative to the image, and the topics and interval (if set) override those of the flow definition.
+func renderInstance(imagePath string, topics []string, interval string) (map[string]interface{}, error) {
+	// Look for the first existing TOML config file in priority order
+	var imageFlowDefinitionPath string
+	for _, candidate := range []string{"flow.toml", "pipeline.toml"} {
+		candidatePath := filepath.Join(imagePath, candidate)
+		if _, err := os.Stat(candidatePath); err == nil {
+			imageFlowDefinitionPath = candidatePath
+			break
 		}
-		for _, entry := range entries {
-			if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".toml") {
-				continue
+	}
+	if _, err := os.Stat(imageFlowDefinitionPath); err == nil {
+		// Load flow definition as a map to preserve all fields
+		var m map[string]interface{}
+		if _, err := toml.DecodeFile(imageFlowDefinitionPath, &m); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", imageFlowDefinitionPath, err)
+		}
+		// Always update topics from CLI using a helper to set nested keys
+		if len(topics) > 0 {
+			if err := maputil.SetNestedMapValue(m, []string{"input", "mqtt", "topics"}, topics); err != nil {
+				return nil, fmt.Errorf("failed to set input.mqtt.topics: %w", err)
 			}
-			name := strings.TrimSuffix(entry.Name(), ".toml")
-			if _, already := provided[name]; already {
-				continue
+		}
+		if stepsRaw, ok := m["steps"]; ok {
+			var newSteps []map[string]interface{}
+			switch steps := stepsRaw.(type) {
+			case []map[string]interface{}:
+				newSteps = steps
+			case []interface{}:
+				for _, s := range steps {
+					if stepMap, ok := s.(map[string]interface{}); ok {
+						newSteps = append(newSteps, stepMap)
+					}
+				}
 			}
-			if strings.HasPrefix(name, toComplete) {
-				completions = append(completions, name)
+			for i, step := range newSteps {
+				if err := resolveStepScript(imagePath, step); err != nil {
+					return nil, fmt.Errorf("invalid step %d of %s: %w", i+1, imageFlowDefinitionPath, err)
+				}
 			}
+			m["steps"] = newSteps
 		}
-		return completions, cobra.ShellCompDirectiveNoFileComp
-	},
+		if err := overrideInstance(m, nil, interval); err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+	// Fallback: create minimal config running the conventional entrypoint of the image
+	scriptPath := filepath.Join(imagePath, "lib/main.js")
+	if _, err := os.Stat(scriptPath); err != nil {
+		return nil, fmt.Errorf("image has neither a flow definition (flow.toml) nor a lib/main.js script: %w", err)
+	}
+	var intervalPtr *string
+	if interval != "" {
+		intervalPtr = &interval
+	}
+	data := map[string]interface{}{
+		"steps": []map[string]interface{}{
+			{
+				"script":   scriptPath,
+				"interval": intervalPtr,
+			},
+		},
+	}
+	if len(topics) > 0 {
+		if err := maputil.SetNestedMapValue(data, []string{"input", "mqtt", "topics"}, topics); err != nil {
+			return nil, fmt.Errorf("failed to set input.mqtt.topics: %w", err)
+		}
+	}
+	return data, nil
+}
+
+// resolveStepScript replaces the script of a step, which is relative to the image root, with its path
+// in the image folder. Steps which do not run a script (e.g. built-in functions of the flows engine) are left untouched.
+func resolveStepScript(imagePath string, step map[string]interface{}) error {
+	v, ok := step["script"]
+	if !ok {
+		return nil
+	}
+	script, ok := v.(string)
+	if !ok || script == "" {
+		return fmt.Errorf("script must be a non-empty string")
+	}
+	if !filepath.IsLocal(filepath.FromSlash(script)) {
+		return fmt.Errorf("script must be a path inside the image. script=%s", script)
+	}
+	scriptPath := filepath.Join(imagePath, filepath.FromSlash(script))
+	info, err := os.Stat(scriptPath)
+	if err != nil {
+		return fmt.Errorf("script not found in image. script=%s", script)
+	}
+	if info.IsDir() {
+		return fmt.Errorf("script is a directory. script=%s", script)
+	}
+	step["script"] = scriptPath
+	return nil
+}
+
+var removeInstanceCmd = &cobra.Command{
+	Use:     "remove [instance_name]",
+	Short:   "Remove a deployed flow instance",
+	Aliases: []string{"rm"},
+	Example: `# Remove a deployed instance, keeping its params for a later deployment
+$ tedge-oscar flows instances remove myinstance
+
+# Remove a deployed instance along with its params
+$ tedge-oscar flows instances remove myinstance --purge`,
+	Args:              cobra.ExactArgs(1),
+	SilenceUsage:      true, // Do not show help on runtime errors
+	ValidArgsFunction: completeInstanceNames,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		cfgPath := configPath
 		if cfgPath == "" {
@@ -484,33 +615,70 @@ $ tedge-oscar flows instances remove myinstance`,
 			return fmt.Errorf("failed to evaluate deployDir: %w", err)
 		}
 		instanceName := args[0]
-		// Find the matching file by instance name (basename without .toml)
-		var matchFile string
-		entries, err := os.ReadDir(deployDir)
-		if err != nil {
+		if _, err := os.Stat(deployDir); err != nil {
 			return fmt.Errorf("failed to read deploy dir: %w", err)
 		}
-		for _, entry := range entries {
-			if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".toml") {
-				continue
-			}
-			if strings.TrimSuffix(entry.Name(), ".toml") == instanceName {
-				matchFile = filepath.Join(deployDir, entry.Name())
-				break
-			}
+		deployDirLock, err := lockDeployDir(cmd, deployDir)
+		if err != nil {
+			return err
 		}
-		if matchFile == "" {
+		defer deployDirLock.Release()
+		matchFile, layout, err := findInstance(deployDir, instanceName)
+		if err != nil {
+			// The params kept when the instance was removed are only removed when purging
+			if _, err := os.Stat(paramsPath(deployDir, instanceName)); err == nil && !preserveParams(cmd) {
+				if err := os.Remove(paramsPath(deployDir, instanceName)); err != nil {
+					return fmt.Errorf("failed to remove params: %w", err)
+				}
+				_ = os.Remove(filepath.Join(deployDir, instanceName))
+				fmt.Fprintf(cmd.ErrOrStderr(), "Params of instance %s removed\n", instanceName)
+				return nil
+			}
 			fmt.Fprintf(cmd.ErrOrStderr(), "Instance %s does not exist, skipping removal.\n", instanceName)
 			return nil
 		}
-		if err := os.Remove(matchFile); err != nil {
-			return fmt.Errorf("failed to remove instance file: %w", err)
+		if layout == config.LayoutDir {
+			matchFile = filepath.Dir(matchFile)
+		} else {
+			if err := os.Remove(matchFile); err != nil {
+				return fmt.Errorf("failed to remove instance file: %w", err)
+			}
+			if err := os.Remove(matchFile + util.BackupSuffix); err != nil && !os.IsNotExist(err) {
+				slog.Warn("Failed to remove backup of instance file", "path", matchFile+util.BackupSuffix, "error", err)
+			}
+		}
+		// The folder of the instance holds its files (dir layout) and its params (both layouts)
+		if err := removeInstanceFolder(filepath.Join(deployDir, instanceName), preserveParams(cmd)); err != nil {
+			return fmt.Errorf("failed to remove instance folder: %w", err)
+		}
+		if err := forgetInstance(deployDir, instanceName); err != nil {
+			return err
 		}
 		fmt.Fprintf(cmd.ErrOrStderr(), "Instance %s removed (%s)\n", instanceName, matchFile)
 		return nil
 	},
 }
 
+// commonTopics are the common thin-edge.io MQTT topics, followed by a tab and their description
+var commonTopics = []string{
+	// main device values
+	"te/device/main//\tRegistration (main device)",
+	"te/device/main///m/+\tMeasurements (main device)",
+	"te/device/main///e/+\tEvents (main device)",
+	"te/device/main///a/+\tAlarms (main device)",
+	"te/device/main///twin/+\tTwin (main device)",
+	"te/device/main///cmd/+/+\tCommands (main device)",
+	"te/device/main/service/tedge-mapper-bridge-c8y/status/health\tbuilt-in bridge status",
+	"te/device/main/service/mosquitto-c8y-bridge/status/health\tmosquitto bridge status",
+	// all devices/services
+	"te/+/+/+/+\tRegistration (all devices)",
+	"te/+/+/+/+/m/+\tMeasurements (all devices)",
+	"te/+/+/+/+/e/+\tEvents (all devices)",
+	"te/+/+/+/+/a/+\tAlarms (all devices)",
+	"te/+/+/+/+/twin/+\tTwin (all devices)",
+	"te/+/+/+/+/cmd/+/+\tCommands (all devices)",
+}
+
 func init() {
 	defaultOutput := "jsonl"
 	if util.Isatty(os.Stdout.Fd()) {
@@ -518,7 +686,7 @@ func init() {
 	}
 	listInstancesCmd.Flags().String("mapper", "local", "Mapper associated with the flow")
 	listInstancesCmd.Flags().StringP("output", "o", defaultOutput, "Output format: table|jsonl|tsv")
-	listInstancesCmd.Flags().String("select", "", "Comma separated list of columns to display (e.g. name,image,imageVersion)")
+	listInstancesCmd.Flags().String("select", "", "Comma separated list of columns to display (e.g. name,path,layout,topics,image,imageVersion,digest,reference,requested,source,pinned,deployedAt)")
 	_ = listInstancesCmd.RegisterFlagCompletionFunc("output", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
 		return []string{"table", "jsonl"}, cobra.ShellCompDirectiveNoFileComp
 	})
@@ -529,30 +697,20 @@ func init() {
 	deployCmd.Flags().String("interval", "", "Interval in seconds (optional)")
 	deployCmd.Flags().StringArray("topics", nil, "Input topics (repeatable, optional)")
 	deployCmd.Flags().String("mapper", "local", "Mapper to deploy the flow to")
+	deployCmd.Flags().Bool("pin", false, "Deploy the image by digest, so that the instance is not affected by a later pull of the tag")
+	deployCmd.Flags().StringArray("param", nil, "Param of the instance as key=value, e.g. debug=true or alarm.severity=major (repeatable, optional, dir layout only)")
+	deployCmd.Flags().String("params-file", "", "TOML file with params of the instance (optional, overridden by --param, dir layout only)")
+	deployCmd.Flags().String("layout", "", "Deploy layout: file (a <name>.toml file referencing the image) or dir (a self-contained <name>/flow.toml folder) (default: deploy_layout setting of the config, or file)")
+	_ = deployCmd.RegisterFlagCompletionFunc("layout", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return config.DeployLayouts, cobra.ShellCompDirectiveNoFileComp
+	})
+	deployCmd.Flags().String("pull", "", "Pull policy: always|if-not-present|never (default: pull_policy setting of the config, or if-not-present)")
+	_ = deployCmd.RegisterFlagCompletionFunc("pull", completePullPolicies)
 
 	removeInstanceCmd.Flags().String("mapper", "local", "Mapper to remove the flow from")
+	removeInstanceCmd.Flags().Bool("purge", false, "Also remove the params of the instance (default: keep them, unless PRESERVE_CONFIG_ON_DELETE=0)")
 
 	_ = deployCmd.RegisterFlagCompletionFunc("topics", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
-		// Common thin-edge.io MQTT topics
-		commonTopics := []string{
-			// main device values
-			"te/device/main//\tRegistration (main device)",
-			"te/device/main///m/+\tMeasurements (main device)",
-			"te/device/main///e/+\tEvents (main device)",
-			"te/device/main///a/+\tAlarms (main device)",
-			"te/device/main///twin/+\tTwin (main device)",
-			"te/device/main///cmd/+/+\tCommands (main device)",
-			"te/device/main/service/tedge-mapper-bridge-c8y/status/health\tbuilt-in bridge status",
-			"te/device/main/service/mosquitto-c8y-bridge/status/health\tmosquitto bridge status",
-			// all devices/services
-			"te/+/+/+/+\tRegistration (all devices)",
-			"te/+/+/+/+/m/+\tMeasurements (all devices)",
-			"te/+/+/+/+/e/+\tEvents (all devices)",
-			"te/+/+/+/+/a/+\tAlarms (all devices)",
-			"te/+/+/+/+/twin/+\tTwin (all devices)",
-			"te/+/+/+/+/cmd/+/+\tCommands (all devices)",
-		}
-
 		// TODO Add common suffixes to the given users options
 		// commonSuffixes := []string{
 		// 	"/m/",
@@ -579,9 +737,114 @@ func init() {
 	flowsCmd.AddCommand(instancesCmd)
 }
 
-// Helper to get terminal width
-func terminalSize() (width int, height int, err error) {
-	fd := int(os.Stdout.Fd())
-	w, h, err := term.GetSize(fd)
-	return w, h, err
+// lockDeployDir takes the lock of a mapper's deploy_dir, which must be held while writing instance files
+func lockDeployDir(cmd *cobra.Command, deployDir string) (*lock.Lock, error) {
+	return lock.Acquire(cmd.Context(), deployDir, lockTimeout)
+}
+
+// completeInstanceNames completes the names of the instances deployed to the deploy_dir of the mapper (--mapper flag)
+func completeInstanceNames(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	cfgPath := configPath
+	if cfgPath == "" {
+		cfgPath = config.DefaultConfigPath()
+	}
+	cfg, err := config.LoadConfig(cfgPath)
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	mapper := "local"
+	if v, err := cmd.Flags().GetString("mapper"); err == nil {
+		mapper = v
+	}
+	deployDir, err := cfg.GetDeployDir(mapper)
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	instances, err := findInstances(deployDir)
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	var completions []string
+	provided := make(map[string]struct{})
+	for _, arg := range args {
+		provided[arg] = struct{}{}
+	}
+	for _, inst := range instances {
+		if _, already := provided[inst.Name]; already {
+			continue
+		}
+		if strings.HasPrefix(inst.Name, toComplete) {
+			completions = append(completions, inst.Name)
+		}
+	}
+	return completions, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completePullPolicies completes the values of the --pull flag
+func completePullPolicies(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	return []string{
+		config.PullAlways + "\tCheck the registry for a new digest of the tag",
+		config.PullIfNotPresent + "\tOnly pull the image if it is not available locally",
+		config.PullNever + "\tOnly use local images",
+	}, cobra.ShellCompDirectiveNoFileComp
+}
+
+// recordInstance records the image of a deployed instance in the lockfile of the deploy_dir, and adds
+// the instance (unless nil) to its history so that it can be rolled back to
+func recordInstance(cfg *config.Config, deployDir string, name string, entry lockfile.Entry, data map[string]interface{}) error {
+	lf, err := lockfile.Load(deployDir)
+	if err != nil {
+		return err
+	}
+	lf.Instances[name] = entry
+	if err := lf.Save(deployDir); err != nil {
+		return fmt.Errorf("failed to write lockfile: %w", err)
+	}
+	if cfg.HistoryLimit <= 0 || data == nil {
+		return nil
+	}
+	text, err := encodeInstance(data)
+	if err != nil {
+		return err
+	}
+	h, err := history.Load(deployDir, name)
+	if err != nil {
+		return err
+	}
+	h.Add(entry, text, cfg.HistoryLimit)
+	if err := h.Save(deployDir, name); err != nil {
+		return fmt.Errorf("failed to write history: %w", err)
+	}
+	return nil
+}
+
+// forgetInstance removes a removed instance from the lockfile of the deploy_dir, along with its history
+func forgetInstance(deployDir string, name string) error {
+	if err := history.Remove(deployDir, name); err != nil {
+		return fmt.Errorf("failed to remove history: %w", err)
+	}
+	lf, err := lockfile.Load(deployDir)
+	if err != nil {
+		return err
+	}
+	if _, ok := lf.Instances[name]; !ok {
+		return nil
+	}
+	delete(lf.Instances, name)
+	if err := lf.Save(deployDir); err != nil {
+		return fmt.Errorf("failed to write lockfile: %w", err)
+	}
+	return nil
+}
+
+// writeInstanceFile atomically replaces the instance definition, as it is watched by the mapper.
+// The previous definition is kept as a backup, and is left in place if writing fails.
+func writeInstanceFile(ctx context.Context, path string, data map[string]interface{}) error {
+	// Do not start writing if the command was already cancelled
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(path, 0644, func(w io.Writer) error {
+		return toml.NewEncoder(w).Encode(data)
+	})
 }
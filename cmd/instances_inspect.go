@@ -0,0 +1,208 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/spf13/cobra"
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/imagestore"
+	"github.com/thin-edge/tedge-oscar/internal/lockfile"
+	"github.com/thin-edge/tedge-oscar/internal/params"
+	"github.com/thin-edge/tedge-oscar/pkg/types/flows"
+)
+
+// instanceInfo describes a deployed instance
+type instanceInfo struct {
+	Name   string `json:"name"`
+	Mapper string `json:"mapper"`
+	Path   string `json:"path"`
+	Layout string `json:"layout"`
+	// Deployment is the image recorded in the lockfile, if any
+	Deployment *lockfile.Entry `json:"deployment,omitempty"`
+	Topics     []string        `json:"topics"`
+	Steps      []stepInfo      `json:"steps"`
+	ParamsPath string          `json:"paramsPath"`
+	// Params are the params set for the instance
+	Params map[string]any `json:"params"`
+	// Defaults are the default params of the params schema of the image, or the params documented by its params template
+	Defaults map[string]any `json:"defaults,omitempty"`
+}
+
+type stepInfo struct {
+	Script  string `json:"script,omitempty"`
+	Builtin string `json:"builtin,omitempty"`
+}
+
+var inspectInstanceCmd = &cobra.Command{
+	Use:   "inspect [instance_name]",
+	Short: "Show the image, steps and params of a deployed flow instance",
+	Example: `# Inspect an instance
+$ tedge-oscar flows instances inspect myinstance
+
+# Inspect an instance as JSON
+$ tedge-oscar flows instances inspect myinstance -o json`,
+	Args:              cobra.ExactArgs(1),
+	SilenceUsage:      true, // Do not show help on runtime errors
+	ValidArgsFunction: completeInstanceNames,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		outputFormat, err := cmd.Flags().GetString("output")
+		if err != nil {
+			return err
+		}
+		cfgPath := configPath
+		if cfgPath == "" {
+			cfgPath = config.DefaultConfigPath()
+		}
+		cfg, err := config.LoadConfig(cfgPath)
+		if err != nil {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
+		mapper := "local"
+		if v, err := cmd.Flags().GetString("mapper"); err == nil {
+			mapper = v
+		}
+		deployDir, err := cfg.GetDeployDir(mapper)
+		if err != nil {
+			return fmt.Errorf("failed to evaluate deployDir: %w", err)
+		}
+		instanceName := args[0]
+		path, layout, err := findInstance(deployDir, instanceName)
+		if err != nil {
+			return err
+		}
+		var file flows.InstanceFile
+		if _, err := toml.DecodeFile(path, &file); err != nil {
+			return fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		info := instanceInfo{
+			Name:       instanceName,
+			Mapper:     mapper,
+			Path:       path,
+			Layout:     layout,
+			Topics:     file.Input.MQTT.Topics,
+			ParamsPath: paramsPath(deployDir, instanceName),
+		}
+		for _, step := range file.Steps {
+			info.Steps = append(info.Steps, stepInfo{Script: step.Script, Builtin: step.Builtin})
+		}
+		lf, err := lockfile.Load(deployDir)
+		if err != nil {
+			return err
+		}
+		if entry, ok := lf.Instances[instanceName]; ok {
+			info.Deployment = &entry
+		}
+		if info.Params, err = params.Load(info.ParamsPath); err != nil {
+			return err
+		}
+
+		// The params schema and template are part of the image, which is copied to the folder of the instance by the dir layout
+		templateDir := filepath.Dir(path)
+		if layout == config.LayoutFile {
+			templateDir = ""
+			store := imagestore.New(cfg.ImageDir)
+			if img, err := store.FindImage(file.Script()); err == nil {
+				templateDir = img.Dir
+			}
+		}
+		// The values of secret params are never shown. Without the schema of the image, the secret params recorded
+		// in the lockfile are redacted, or all params if the instance has no lockfile entry.
+		var schema *params.Schema
+		if templateDir != "" {
+			var template map[string]any
+			if schema, template, err = loadImageParams(templateDir); err != nil {
+				return err
+			}
+			info.Defaults = template
+		}
+		switch {
+		case schema != nil:
+			info.Defaults = schema.Defaults()
+			info.Params = schema.Redact(info.Params)
+		case info.Deployment != nil:
+			info.Params = params.RedactKeys(info.Params, info.Deployment.Secrets)
+		case templateDir == "":
+			info.Params = params.RedactAll(info.Params)
+		}
+
+		if outputFormat == "json" {
+			enc := json.NewEncoder(cmd.OutOrStdout())
+			enc.SetEscapeHTML(false)
+			enc.SetIndent("", "  ")
+			return enc.Encode(info)
+		}
+		return printInstanceInfo(cmd.OutOrStdout(), info)
+	},
+}
+
+// printInstanceInfo writes the human-readable view of an inspected instance
+func printInstanceInfo(out io.Writer, info instanceInfo) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Name:\t%s\n", info.Name)
+	fmt.Fprintf(w, "Mapper:\t%s\n", info.Mapper)
+	fmt.Fprintf(w, "Path:\t%s\n", info.Path)
+	fmt.Fprintf(w, "Layout:\t%s\n", info.Layout)
+	if d := info.Deployment; d != nil {
+		fmt.Fprintf(w, "Image:\t%s\n", d.Image)
+		fmt.Fprintf(w, "Requested:\t%s\n", d.Requested)
+		fmt.Fprintf(w, "Digest:\t%s\n", d.Digest)
+		fmt.Fprintf(w, "Deployed at:\t%s\n", d.DeployedAt.Format(time.RFC3339))
+	}
+	fmt.Fprintf(w, "Topics:\t%s\n", strings.Join(info.Topics, ", "))
+	fmt.Fprintln(w, "Steps:")
+	for i, step := range info.Steps {
+		if step.Builtin != "" {
+			fmt.Fprintf(w, "  %d:\tbuiltin %s\n", i+1, step.Builtin)
+		} else {
+			fmt.Fprintf(w, "  %d:\t%s\n", i+1, step.Script)
+		}
+	}
+	fmt.Fprintf(w, "Params file:\t%s\n", info.ParamsPath)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	keys, values := params.Flatten(info.Params)
+	defaultKeys, defaults := params.Flatten(info.Defaults)
+	for _, key := range defaultKeys {
+		if _, ok := values[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if len(keys) == 0 {
+		return nil
+	}
+	fmt.Fprintln(out, "Params:")
+	w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "  KEY\tVALUE\tSOURCE")
+	for _, key := range keys {
+		value, source := values[key], params.FileName
+		if _, ok := values[key]; !ok {
+			value, source = defaults[key], "default"
+		}
+		b, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "  %s\t%s\t%s\n", key, b, source)
+	}
+	return w.Flush()
+}
+
+func init() {
+	inspectInstanceCmd.Flags().String("mapper", "local", "Mapper the flow is deployed to")
+	inspectInstanceCmd.Flags().StringP("output", "o", "text", "Output format: text|json")
+	_ = inspectInstanceCmd.RegisterFlagCompletionFunc("output", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{"text", "json"}, cobra.ShellCompDirectiveNoFileComp
+	})
+	instancesCmd.AddCommand(inspectInstanceCmd)
+}
@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/thin-edge/tedge-oscar/internal/lockfile"
+	"github.com/thin-edge/tedge-oscar/internal/params"
+)
+
+const testSchema = `[[params]]
+name = "token"
+type = "string"
+required = true
+secret = true
+`
+
+func TestInspectInstanceRedactsSecretsWithoutSchema(t *testing.T) {
+	env := newTestEnv(t)
+	tarball := filepath.Join(t.TempDir(), "counter:1.0.tar")
+	writeTarball(t, tarball, map[string]string{
+		"flow.toml":           testFlow,
+		"lib/main.js":         "// 1.0",
+		params.SchemaFileName: testSchema,
+	})
+	if _, err := env.run(t, "flows", "images", "load", tarball); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.run(t, "flows", "instances", "deploy", "a", "counter:1.0", "--pull", "never", "--layout", "dir", "--param", "token=s3cr3t"); err != nil {
+		t.Fatal(err)
+	}
+	// e.g. the schema was removed from the folder of the instance
+	if err := os.Remove(filepath.Join(env.DeployDir, "a", params.SchemaFileName)); err != nil {
+		t.Fatal(err)
+	}
+	out, err := env.run(t, "flows", "instances", "inspect", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out, "s3cr3t") {
+		t.Fatalf("secret param recorded in the lockfile is shown: %s", out)
+	}
+
+	// Without a lockfile entry, it is unknown which params are secret
+	if err := os.Remove(filepath.Join(env.DeployDir, lockfile.FileName)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(env.DeployDir, "a", flowFile)); err != nil {
+		t.Fatal(err)
+	}
+	instance := "[[steps]]\nscript = '" + filepath.Join(t.TempDir(), "main.js") + "'\n"
+	if err := os.WriteFile(filepath.Join(env.DeployDir, "a.toml"), []byte(instance), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if out, err = env.run(t, "flows", "instances", "inspect", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out, "s3cr3t") || !strings.Contains(out, "token") {
+		t.Fatalf("params are not redacted: %s", out)
+	}
+}
@@ -0,0 +1,148 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/imagestore"
+	"github.com/thin-edge/tedge-oscar/internal/params"
+)
+
+// flowFile is the instance file of an instance deployed using the dir layout, i.e. <deploy_dir>/<name>/flow.toml
+const flowFile = "flow.toml"
+
+// findInstances returns the name, path and layout of the instances deployed to deployDir, using either the
+// file layout (<name>.toml) or the dir layout (<name>/flow.toml). Hidden folders (e.g. the history) are skipped.
+func findInstances(deployDir string) ([]instance, error) {
+	entries, err := os.ReadDir(deployDir)
+	if err != nil {
+		return nil, err
+	}
+	instances := []instance{}
+	for _, entry := range entries {
+		switch {
+		case strings.HasPrefix(entry.Name(), "."):
+			continue
+		case entry.IsDir():
+			path := filepath.Join(deployDir, entry.Name(), flowFile)
+			if _, err := os.Stat(path); err == nil {
+				instances = append(instances, instance{Name: entry.Name(), Path: path, Layout: config.LayoutDir})
+			}
+		case strings.HasSuffix(entry.Name(), ".toml"):
+			instances = append(instances, instance{
+				Name:   strings.TrimSuffix(entry.Name(), ".toml"),
+				Path:   filepath.Join(deployDir, entry.Name()),
+				Layout: config.LayoutFile,
+			})
+		}
+	}
+	return instances, nil
+}
+
+// findInstance returns the path of the instance file of a deployed instance and the layout it uses
+func findInstance(deployDir string, name string) (string, string, error) {
+	path := filepath.Join(deployDir, name+".toml")
+	if info, err := os.Stat(path); err == nil && !info.IsDir() {
+		return path, config.LayoutFile, nil
+	}
+	path = filepath.Join(deployDir, name, flowFile)
+	if _, err := os.Stat(path); err == nil {
+		return path, config.LayoutDir, nil
+	}
+	return "", "", fmt.Errorf("instance %s does not exist in %s: %w", name, deployDir, os.ErrNotExist)
+}
+
+// deployInstanceDir deploys an instance using the dir layout: the files of the image are copied to
+// <deployDir>/<name>, replacing any previous version, and the instance is written to its flow.toml.
+// The scripts of the instance are made relative to the folder, so that it is self-contained.
+// The params file is set to instanceParams, or kept from the previous version if nil.
+func deployInstanceDir(ctx context.Context, deployDir string, name string, imagePath string, data map[string]interface{}, instanceParams map[string]any) (string, error) {
+	if err := relativeScripts(data, imagePath); err != nil {
+		return "", err
+	}
+	dir := filepath.Join(deployDir, name)
+	// The files are assembled in a hidden folder, which is skipped when looking for instances
+	staging, err := os.MkdirTemp(deployDir, "."+name+".staging-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create staging folder: %w", err)
+	}
+	defer os.RemoveAll(staging)
+	if err := imagestore.ExportFiles(ctx, imagePath, staging, "flow.toml", "pipeline.toml"); err != nil {
+		return "", fmt.Errorf("failed to copy the image files: %w", err)
+	}
+	if instanceParams == nil {
+		if existing, err := os.ReadFile(paramsPath(deployDir, name)); err == nil {
+			if err := os.WriteFile(filepath.Join(staging, params.FileName), existing, 0644); err != nil {
+				return "", err
+			}
+		}
+	} else if err := params.Save(filepath.Join(staging, params.FileName), instanceParams); err != nil {
+		return "", fmt.Errorf("failed to write params: %w", err)
+	}
+	old := ""
+	if _, err := os.Lstat(dir); err == nil {
+		old = staging + ".old"
+		if err := os.Rename(dir, old); err != nil {
+			return "", fmt.Errorf("failed to replace instance folder: %w", err)
+		}
+	}
+	if err := os.Rename(staging, dir); err != nil {
+		if old != "" {
+			_ = os.Rename(old, dir)
+		}
+		return "", fmt.Errorf("failed to move instance folder into place: %w", err)
+	}
+	if old != "" {
+		if err := os.RemoveAll(old); err != nil {
+			return "", err
+		}
+	}
+	// The instance file is written last, so the flow is only loaded once all its files are in place
+	path := filepath.Join(dir, flowFile)
+	if err := writeInstanceFile(ctx, path, data); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// relativeScripts makes the scripts of the steps of an instance relative to the given folder
+func relativeScripts(data map[string]interface{}, root string) error {
+	steps, _ := data["steps"].([]map[string]interface{})
+	for _, step := range steps {
+		script, ok := step["script"].(string)
+		if !ok || !filepath.IsAbs(script) {
+			continue
+		}
+		rel, err := filepath.Rel(root, script)
+		if err != nil {
+			return err
+		}
+		step["script"] = filepath.ToSlash(rel)
+	}
+	return nil
+}
+
+// moveScripts updates the scripts of the steps of an instance which are located in the folder from, so that
+// they refer to the same files in the folder to
+func moveScripts(data map[string]interface{}, from string, to string) error {
+	steps, _ := data["steps"].([]map[string]interface{})
+	for _, step := range steps {
+		script, ok := step["script"].(string)
+		if !ok || !filepath.IsAbs(script) {
+			continue
+		}
+		rel, err := filepath.Rel(from, script)
+		if err != nil {
+			return err
+		}
+		if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		step["script"] = filepath.Join(to, rel)
+	}
+	return nil
+}
@@ -2,13 +2,12 @@ package cmd
 
 import (
 	"fmt"
-	"os"
-	"path/filepath"
 
 	"github.com/spf13/cobra"
 	"github.com/thin-edge/tedge-oscar/internal/artifact"
 	"github.com/thin-edge/tedge-oscar/internal/config"
 	"github.com/thin-edge/tedge-oscar/internal/imagepull"
+	"github.com/thin-edge/tedge-oscar/internal/imagestore"
 )
 
 var loadCmd = &cobra.Command{
@@ -18,26 +17,35 @@ var loadCmd = &cobra.Command{
 	RunE: func(cmd *cobra.Command, args []string) error {
 		source := args[0]
 		outputDir, _ := cmd.Flags().GetString("output-dir")
+		cfgPath := configPath
+		if cfgPath == "" {
+			cfgPath = config.DefaultConfigPath()
+		}
+		cfg, err := config.LoadConfig(cfgPath)
+		if err != nil {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
 		if outputDir == "" {
-			cfgPath := configPath
-			if cfgPath == "" {
-				cfgPath = config.DefaultConfigPath()
-			}
-			cfg, err := config.LoadConfig(cfgPath)
+			imageRef, err := artifact.ReferenceFromTarball(source)
 			if err != nil {
-				return fmt.Errorf("failed to load config: %w", err)
+				return err
 			}
-			name, err := artifact.ParseName(source, false)
+			imageDirLock, err := lockImageDir(cmd, cfg)
 			if err != nil {
 				return err
 			}
-			outputDir = filepath.Join(cfg.ImageDir, name)
-		}
-		if err := os.MkdirAll(outputDir, 0755); err != nil {
-			return fmt.Errorf("failed to create output dir: %w", err)
+			defer imageDirLock.Release()
+			store := imagestore.New(cfg.ImageDir)
+			// Images loaded from a tarball are stored under the local registry namespace
+			outputDir = store.Path(artifact.Reference{
+				Registry:   artifact.LocalRegistry,
+				Repository: imageRef.Base(),
+				Tag:        imageRef.Tag,
+				Digest:     imageRef.Digest,
+			})
 		}
 		fmt.Fprintf(cmd.ErrOrStderr(), "Loading image from %s to %s\n", source, outputDir)
-		if err := imagepull.LoadTarballImage(source, outputDir); err != nil {
+		if err := imagepull.LoadTarballImage(cmd.Context(), cfg, source, outputDir); err != nil {
 			return fmt.Errorf("failed to load image: %w", err)
 		}
 		fmt.Fprintf(cmd.OutOrStdout(), "Image loaded to %s\n", outputDir)
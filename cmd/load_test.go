@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/thin-edge/tedge-oscar/internal/imageinspect"
+	"github.com/thin-edge/tedge-oscar/internal/lockfile"
+)
+
+const testFlow = `input.mqtt.topics = ["te/device/main///m/+"]
+
+[[steps]]
+script = "lib/main.js"
+`
+
+func TestLoadListDeployFlowPackage(t *testing.T) {
+	env := newTestEnv(t)
+	// A package in the flow format, which has no manifest
+	tarball := filepath.Join(t.TempDir(), "counter:1.0.tar")
+	writeTarball(t, tarball, map[string]string{
+		"flow.toml":   testFlow,
+		"lib/main.js": "export function onMessage(message) { return [message] }",
+	})
+	if _, err := env.run(t, "flows", "images", "load", tarball); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := env.run(t, "flows", "images", "list", "--output", "tsv", "--select", "reference")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "local/counter:1.0") {
+		t.Fatalf("loaded image is not listed. got=%q", out)
+	}
+
+	if _, err := env.run(t, "flows", "instances", "deploy", "a", "counter:1.0", "--pull", "never"); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(env.DeployDir, "a.toml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := filepath.Join(env.ImageDir, "local", "counter", "1.0", "lib", "main.js")
+	if !strings.Contains(string(b), script) {
+		t.Fatalf("instance does not run the script of the loaded image. got=%s", b)
+	}
+	// The image is recorded using the reference of the loaded image, as it can not be pulled from Docker Hub
+	lf, err := lockfile.Load(env.DeployDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := lf.Instances["a"].Image; got != "local/counter:1.0" {
+		t.Fatalf("unexpected image of the instance. got=%s, expected=local/counter:1.0", got)
+	}
+}
+
+func TestInspectLoadedFlowPackage(t *testing.T) {
+	env := newTestEnv(t)
+	tarball := filepath.Join(t.TempDir(), "counter:1.0.tar")
+	writeTarball(t, tarball, map[string]string{
+		"flow.toml":   testFlow,
+		"lib/main.js": "export function onMessage(message) { return [message] }",
+	})
+	if _, err := env.run(t, "flows", "images", "load", tarball); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := env.run(t, "flows", "images", "inspect", "local/counter:1.0", "--output", "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info imageinspect.Info
+	if err := json.Unmarshal([]byte(out), &info); err != nil {
+		t.Fatalf("invalid output: %v. got=%s", err, out)
+	}
+	if info.Reference != "local/counter:1.0" || !info.NoManifest {
+		t.Fatalf("unexpected image info. got=%s", out)
+	}
+	files := map[string]int64{}
+	for _, file := range info.Files {
+		files[file.Name] = file.Size
+	}
+	if files["flow.toml"] != int64(len(testFlow)) {
+		t.Fatalf("flow.toml is not listed with its size. got=%v", info.Files)
+	}
+	if _, ok := files["lib/main.js"]; !ok {
+		t.Fatalf("lib/main.js is not listed. got=%v", info.Files)
+	}
+
+	out, err = env.run(t, "flows", "images", "inspect", "local/counter:1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "not stored") || !strings.Contains(out, "lib/main.js") {
+		t.Fatalf("output does not state that the manifest is not stored. got=%s", out)
+	}
+}
@@ -0,0 +1,309 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/thin-edge/tedge-oscar/internal/artifact"
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/imagepull"
+	"github.com/thin-edge/tedge-oscar/internal/imagestore"
+	"github.com/thin-edge/tedge-oscar/internal/imagetags"
+	"github.com/thin-edge/tedge-oscar/internal/registryauth"
+	"github.com/thin-edge/tedge-oscar/internal/util"
+)
+
+const (
+	statusUpToDate     = "up-to-date"
+	statusTagMoved     = "tag-moved"
+	statusNewerVersion = "newer-version"
+	statusLocal        = "local"
+	statusUnknown      = "unknown"
+	statusError        = "error"
+)
+
+// outdatedInstance compares the image of a deployed instance with the versions available in the registry
+type outdatedInstance struct {
+	Mapper   string `json:"mapper"`
+	Instance string `json:"instance"`
+	Image    string `json:"image"`
+	// Version is the deployed tag (or the digest if the image was deployed by digest)
+	Version string `json:"version"`
+	// ImageVersion is the version annotation of the deployed image, which is only shown for information
+	ImageVersion string `json:"imageVersion,omitempty"`
+	Digest       string `json:"digest"`
+	// RegistryDigest is the digest the tag of the deployed image currently points to
+	RegistryDigest string `json:"registryDigest,omitempty"`
+	// Latest is the highest version available in the registry
+	Latest       string `json:"latest,omitempty"`
+	LatestDigest string `json:"latestDigest,omitempty"`
+	Status       string `json:"status"`
+	Error        string `json:"error,omitempty"`
+}
+
+// imageUpdate describes the versions of a deployed image available in the registry
+type imageUpdate struct {
+	registryDigest string
+	latest         string
+	latestDigest   string
+	err            error
+}
+
+var outdatedCmd = &cobra.Command{
+	Use:   "outdated",
+	Short: "List deployed flow instances whose image has a newer version in the registry",
+	Long: `List deployed flow instances whose image has a newer version in the registry.
+The instances of all mappers are checked. An instance is outdated if the tag of its image
+now points to a different digest (tag-moved), or if a higher semantic version is available (newer-version).`,
+	Example: `# Check the instances of all mappers
+$ tedge-oscar flows images outdated
+
+# Check the instances of a single mapper, as JSON
+$ tedge-oscar flows images outdated --mapper c8y -o json`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true, // Do not show help on runtime errors
+	RunE: func(cmd *cobra.Command, args []string) error {
+		registryauth.SetDebugHTTP(logLevel)
+		outputFormat, err := cmd.Flags().GetString("output")
+		if err != nil {
+			return err
+		}
+		selectCols, err := cmd.Flags().GetString("select")
+		if err != nil {
+			return err
+		}
+		var colNames []string
+		if selectCols != "" {
+			colNames = strings.Split(selectCols, ",")
+		} else {
+			colNames = []string{"mapper", "instance", "image", "version", "latest", "status", "digest", "latestDigest"}
+		}
+		mapperFilter, err := cmd.Flags().GetString("mapper")
+		if err != nil {
+			return err
+		}
+
+		cfgPath := configPath
+		if cfgPath == "" {
+			cfgPath = config.DefaultConfigPath()
+		}
+		cfg, err := config.LoadConfig(cfgPath)
+		if err != nil {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
+		deployDirs, err := cfg.DeployDirs()
+		if err != nil {
+			return fmt.Errorf("failed to evaluate deployDir: %w", err)
+		}
+		mappers := []string{}
+		for mapper := range deployDirs {
+			if mapperFilter == "" || mapper == mapperFilter {
+				mappers = append(mappers, mapper)
+			}
+		}
+		sort.Strings(mappers)
+		store := imagestore.New(cfg.ImageDir)
+
+		// Instances often share an image, so each image is only checked once
+		updates := map[string]*imageUpdate{}
+		results := []outdatedInstance{}
+		for _, mapper := range mappers {
+			instances, err := readInstances(store, deployDirs[mapper])
+			if err != nil {
+				return err
+			}
+			for _, inst := range instances {
+				result := outdatedInstance{
+					Mapper:   mapper,
+					Instance: inst.Name,
+					Status:   statusUnknown,
+				}
+				if inst.Err != nil {
+					result.Error = inst.Err.Error()
+					results = append(results, result)
+					continue
+				}
+				ref, digest, ok := deployedImage(inst)
+				if !ok {
+					result.Error = "the image of the instance can not be determined"
+					results = append(results, result)
+					continue
+				}
+				result.Image = ref.Name()
+				result.Version = ref.Version()
+				result.Digest = digest
+				if inst.Image != nil {
+					result.ImageVersion = imagestore.ReadAnnotation(inst.Image.Dir, "org.opencontainers.image.version")
+				}
+				if ref.Registry == artifact.LocalRegistry {
+					// Images loaded from a tarball are not stored in a registry
+					result.Status = statusLocal
+					results = append(results, result)
+					continue
+				}
+				update, ok := updates[ref.String()]
+				if !ok {
+					update = checkImageUpdate(cmd.Context(), cfg, ref)
+					updates[ref.String()] = update
+					if update.err != nil {
+						slog.Warn("Failed to check the image for updates", "image", ref, "error", update.err)
+					}
+				}
+				result.RegistryDigest = update.registryDigest
+				result.Latest = update.latest
+				result.LatestDigest = update.latestDigest
+				result.Status = outdatedStatus(result, update)
+				if update.err != nil {
+					result.Error = update.err.Error()
+				}
+				results = append(results, result)
+			}
+		}
+		if ctxErr := cmd.Context().Err(); ctxErr != nil {
+			return ctxErr
+		}
+
+		if outputFormat == "json" {
+			enc := json.NewEncoder(cmd.OutOrStdout())
+			enc.SetIndent("", "  ")
+			enc.SetEscapeHTML(false)
+			return enc.Encode(results)
+		}
+		if len(results) == 0 {
+			fmt.Fprintln(cmd.ErrOrStderr(), "No flow instances are currently deployed.")
+			return nil
+		}
+		rows := [][]string{}
+		for _, result := range results {
+			rowMap := map[string]string{
+				"mapper":         result.Mapper,
+				"instance":       result.Instance,
+				"image":          result.Image,
+				"version":        result.Version,
+				"imageVersion":   result.ImageVersion,
+				"digest":         result.Digest,
+				"registryDigest": result.RegistryDigest,
+				"latest":         result.Latest,
+				"latestDigest":   result.LatestDigest,
+				"status":         result.Status,
+				"error":          result.Error,
+			}
+			row := make([]string, len(colNames))
+			for i, col := range colNames {
+				row[i] = rowMap[col]
+			}
+			rows = append(rows, row)
+		}
+		return renderRows(cmd.OutOrStdout(), outputFormat, colNames, rows)
+	},
+}
+
+// storedImageVersion returns the version of a stored image, preferring the version annotation over the tag
+func storedImageVersion(img imagestore.Image) string {
+	if v := imagestore.ReadAnnotation(img.Dir, "org.opencontainers.image.version"); v != "" {
+		return v
+	}
+	return img.Reference.Version()
+}
+
+// deployedImage returns the reference (by tag if known) and the digest of the image of an instance. They are read
+// from the image folder of the instance, falling back to the lockfile entry if the image folder has been removed.
+func deployedImage(inst instance) (artifact.Reference, string, bool) {
+	var ref artifact.Reference
+	var digest string
+	if inst.Entry != nil {
+		if entryRef, err := artifact.ParseReference(inst.Entry.Image); err == nil {
+			ref = entryRef
+			digest = inst.Entry.Digest
+		}
+	}
+	if inst.Image != nil {
+		// The image folder of a pinned image is stored by digest, so the tag is taken from the lockfile
+		if inst.Image.Reference.Tag != "" || ref.Tag == "" || ref.Name() != inst.Image.Name() {
+			ref = inst.Image.Reference
+		}
+		if v := imagestore.ReadAnnotation(inst.Image.Dir, imagestore.AnnotationDigest); v != "" {
+			digest = v
+		}
+	}
+	if ref.Repository == "" {
+		return ref, "", false
+	}
+	if ref.Tag != "" {
+		// The tag is checked in the registry, not the digest of a pinned image
+		ref.Digest = ""
+	}
+	return ref, digest, true
+}
+
+// checkImageUpdate queries the registry for the current digest of the tag of an image, and for the highest
+// semantic version which is newer than its tag
+func checkImageUpdate(ctx context.Context, cfg *config.Config, ref artifact.Reference) *imageUpdate {
+	version := ref.Version()
+	update := &imageUpdate{}
+	if ref.Tag != "" {
+		if update.registryDigest, update.err = imagepull.ResolveDigest(ctx, cfg, ref); update.err != nil {
+			return update
+		}
+	}
+	repo, err := registryauth.NewRepository(cfg, ref)
+	if err != nil {
+		update.err = err
+		return update
+	}
+	tags, err := imagetags.List(ctx, repo)
+	if err != nil {
+		update.err = err
+		return update
+	}
+	update.latest = imagetags.Newer(tags, version)
+	if update.latest == "" {
+		// The deployed version is the latest one
+		update.latest = version
+		update.latestDigest = update.registryDigest
+		return update
+	}
+	latestRef := ref
+	latestRef.Tag = update.latest
+	latestRef.Digest = ""
+	update.latestDigest, update.err = imagepull.ResolveDigest(ctx, cfg, latestRef)
+	return update
+}
+
+// outdatedStatus returns the comma separated reasons why an instance is outdated, or up-to-date
+func outdatedStatus(result outdatedInstance, update *imageUpdate) string {
+	if update.err != nil {
+		return statusError
+	}
+	reasons := []string{}
+	if update.registryDigest != "" && update.registryDigest != result.Digest {
+		reasons = append(reasons, statusTagMoved)
+	}
+	if update.latest != result.Version {
+		reasons = append(reasons, statusNewerVersion)
+	}
+	if len(reasons) == 0 {
+		return statusUpToDate
+	}
+	return strings.Join(reasons, ",")
+}
+
+func init() {
+	defaultOutput := "jsonl"
+	if util.Isatty(os.Stdout.Fd()) {
+		defaultOutput = "table"
+	}
+	outdatedCmd.Flags().StringP("output", "o", defaultOutput, "Output format: table|json|jsonl|tsv")
+	outdatedCmd.Flags().String("select", "", "Comma separated list of columns to display (e.g. mapper,instance,image,version,imageVersion,digest,registryDigest,latest,latestDigest,status,error)")
+	outdatedCmd.Flags().String("mapper", "", "Only check the instances of this mapper (default: all mappers)")
+	_ = outdatedCmd.RegisterFlagCompletionFunc("output", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{"table", "json", "jsonl", "tsv"}, cobra.ShellCompDirectiveNoFileComp
+	})
+	imagesCmd.AddCommand(outdatedCmd)
+}
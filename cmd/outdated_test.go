@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/thin-edge/tedge-oscar/internal/artifact"
+	"github.com/thin-edge/tedge-oscar/internal/imagestore"
+	"github.com/thin-edge/tedge-oscar/internal/lockfile"
+)
+
+func TestDeployedImage(t *testing.T) {
+	const dgst = "sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+	dir := t.TempDir()
+	tests := []struct {
+		name       string
+		inst       instance
+		wantRef    string
+		wantDigest string
+		wantOK     bool
+	}{
+		{
+			name: "image folder of the tag",
+			inst: instance{
+				Image: &imagestore.Image{Dir: filepath.Join(dir, "tag"), Reference: artifact.Reference{Registry: "ghcr.io", Repository: "thin-edge/counter", Tag: "1.0"}},
+				Entry: &lockfile.Entry{Image: "ghcr.io/thin-edge/counter:1.0", Digest: dgst},
+			},
+			wantRef:    "ghcr.io/thin-edge/counter:1.0",
+			wantDigest: dgst,
+			wantOK:     true,
+		},
+		{
+			name: "pinned image uses the tag of the lockfile",
+			inst: instance{
+				Image: &imagestore.Image{Dir: filepath.Join(dir, "digest"), Reference: artifact.Reference{Registry: "ghcr.io", Repository: "thin-edge/counter", Digest: dgst}},
+				Entry: &lockfile.Entry{Image: "ghcr.io/thin-edge/counter:1.0@" + dgst, Digest: dgst, Pinned: true},
+			},
+			wantRef:    "ghcr.io/thin-edge/counter:1.0",
+			wantDigest: dgst,
+			wantOK:     true,
+		},
+		{
+			name: "removed image folder falls back to the lockfile",
+			inst: instance{
+				Entry: &lockfile.Entry{Image: "ghcr.io/thin-edge/counter:1.0", Digest: dgst},
+			},
+			wantRef:    "ghcr.io/thin-edge/counter:1.0",
+			wantDigest: dgst,
+			wantOK:     true,
+		},
+		{
+			name:   "unknown image",
+			inst:   instance{},
+			wantOK: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ref, digest, ok := deployedImage(tt.inst)
+			if ok != tt.wantOK {
+				t.Fatalf("unexpected result. got=%v, expected=%v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if ref.String() != tt.wantRef || digest != tt.wantDigest {
+				t.Fatalf("unexpected image. got=%s (digest %s), expected=%s (digest %s)", ref, digest, tt.wantRef, tt.wantDigest)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/olekukonko/tablewriter"
+	"golang.org/x/term"
+)
+
+// renderRows writes rows in the given output format (table, jsonl or tsv). Table columns
+// which do not fit into the width of the terminal are dropped from the right.
+func renderRows(w io.Writer, outputFormat string, colNames []string, rows [][]string) error {
+	if outputFormat == "jsonl" || outputFormat == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		for _, row := range rows {
+			obj := map[string]string{}
+			for i, col := range colNames {
+				obj[col] = row[i]
+			}
+			if err := enc.Encode(obj); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if outputFormat == "tsv" {
+		for _, row := range rows {
+			fmt.Fprintln(w, strings.Join(row, "\t"))
+		}
+		return nil
+	}
+	// Determine which columns fit in one row
+	maxWidth := 0
+	tablePadding := 2 // left + right border
+	columnPadding := 2
+	if w, _, err := terminalSize(); err == nil {
+		maxWidth = w - tablePadding
+	} else {
+		maxWidth = 120 // fallback
+	}
+	colWidths := make([]int, len(colNames))
+	for i := range colNames {
+		colWidths[i] = len(colNames[i]) + columnPadding
+	}
+	for _, row := range rows {
+		for i, cell := range row {
+			if l := len(cell); l > colWidths[i] {
+				colWidths[i] = l + columnPadding
+			}
+		}
+	}
+	total := len(colNames) - 1 // for separators
+	for _, w := range colWidths {
+		total += w
+	}
+	// Remove columns from right until fits
+	keep := len(colNames)
+	for total > maxWidth && keep > 1 {
+		keep--
+		total -= (colWidths[keep] + 1)
+	}
+	// Prepare filtered columns
+	filteredColNames := colNames[:keep]
+	filteredRows := [][]string{}
+	for _, row := range rows {
+		filteredRows = append(filteredRows, row[:keep])
+	}
+	colHeaders := make([]any, len(filteredColNames))
+	for i, v := range filteredColNames {
+		colHeaders[i] = v
+	}
+	table := tablewriter.NewTable(w)
+	table.Header(colHeaders...)
+	table.Bulk(filteredRows)
+	return table.Render()
+}
+
+// Helper to get terminal width
+func terminalSize() (width int, height int, err error) {
+	fd := int(os.Stdout.Fd())
+	w, h, err := term.GetSize(fd)
+	return w, h, err
+}
@@ -0,0 +1,194 @@
+package cmd
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/thin-edge/tedge-oscar/internal/params"
+	"github.com/thin-edge/tedge-oscar/pkg/maputil"
+)
+
+// paramsPath returns the params file of an instance, which is stored in the folder of the instance
+// (<deploy_dir>/<name>/params.toml) as done by the flow sm-plugin. Only instances using the dir layout have
+// params, as the mapper reads the params.toml from the folder of the flow.
+func paramsPath(deployDir string, name string) string {
+	return filepath.Join(deployDir, name, params.FileName)
+}
+
+// loadImageParams returns the params schema and the params template of an image, which are nil if the image
+// has none. If the image has a schema, the template is derived from it.
+func loadImageParams(imagePath string) (*params.Schema, map[string]any, error) {
+	schema, err := params.LoadSchema(filepath.Join(imagePath, params.SchemaFileName))
+	if err != nil {
+		return nil, nil, err
+	}
+	if schema != nil {
+		return schema, schema.Template(), nil
+	}
+	template, err := params.LoadTemplate(filepath.Join(imagePath, params.TemplateFileName))
+	return nil, template, err
+}
+
+// validateParams validates the params against the schema of the image, or its template if it has no schema
+func validateParams(instanceParams map[string]any, schema *params.Schema, template map[string]any) error {
+	if schema != nil {
+		return schema.Validate(instanceParams)
+	}
+	if template != nil {
+		return params.Validate(instanceParams, template)
+	}
+	return nil
+}
+
+// readParamFlags returns the params given by --params-file and --param (which take precedence), validated
+// against the params schema or template of the image. It returns nil if no params are given.
+func readParamFlags(cmd *cobra.Command, schema *params.Schema, template map[string]any) (map[string]any, error) {
+	paramsFile, err := cmd.Flags().GetString("params-file")
+	if err != nil {
+		return nil, err
+	}
+	assignments, err := cmd.Flags().GetStringArray("param")
+	if err != nil {
+		return nil, err
+	}
+	if paramsFile == "" && len(assignments) == 0 {
+		return nil, nil
+	}
+	given := map[string]any{}
+	if paramsFile != "" {
+		if _, err := os.Stat(paramsFile); err != nil {
+			return nil, fmt.Errorf("failed to read params file: %w", err)
+		}
+		fileParams, err := params.Load(paramsFile)
+		if err != nil {
+			return nil, err
+		}
+		maputil.Merge(given, fileParams)
+	}
+	flagParams, err := params.Parse(assignments, template)
+	if err != nil {
+		return nil, err
+	}
+	maputil.Merge(given, flagParams)
+	if template == nil {
+		slog.Warn("The image has no params schema or template, so the params can not be validated", "schema", params.SchemaFileName, "template", params.TemplateFileName)
+		return given, nil
+	}
+	if err := validateParams(given, schema, template); err != nil {
+		return nil, err
+	}
+	return given, nil
+}
+
+// completeRequiredParams sets the required params of the schema which are not set yet. The user is prompted
+// for them if possible, otherwise their default is used. It returns true if a param was set.
+func completeRequiredParams(cmd *cobra.Command, schema *params.Schema, instanceParams map[string]any) (bool, error) {
+	missing := schema.Missing(instanceParams)
+	if len(missing) == 0 {
+		return false, nil
+	}
+	if isInteractive(cmd) {
+		for _, p := range missing {
+			if err := promptParam(cmd, p, instanceParams); err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+	var names []string
+	for _, p := range missing {
+		if p.Default == nil {
+			names = append(names, p.Name)
+			continue
+		}
+		if err := maputil.SetNestedMapValue(instanceParams, strings.Split(p.Name, "."), p.Default); err != nil {
+			return false, err
+		}
+	}
+	if len(names) > 0 {
+		return false, fmt.Errorf("missing required params: %s (set them using --param)", strings.Join(names, ", "))
+	}
+	return true, nil
+}
+
+// promptParam asks the user for the value of a param until a valid value is given
+func promptParam(cmd *cobra.Command, p params.Param, instanceParams map[string]any) error {
+	if p.Description != "" {
+		fmt.Fprintf(cmd.ErrOrStderr(), "%s\n", p.Description)
+	}
+	question := fmt.Sprintf("%s (%s", p.Name, p.Type)
+	if len(p.Enum) > 0 {
+		question += ", one of: " + p.EnumText()
+	}
+	if p.Default != nil {
+		question += fmt.Sprintf(", default: %v", p.Default)
+	}
+	question += "): "
+	for {
+		var answer string
+		var err error
+		if p.Secret {
+			answer, err = promptSecret(cmd, question)
+		} else {
+			answer, err = promptLine(cmd, question)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read param %s: %w", p.Name, err)
+		}
+		if answer == "" && p.Default != nil {
+			return maputil.SetNestedMapValue(instanceParams, strings.Split(p.Name, "."), p.Default)
+		}
+		if answer != "" {
+			err := p.Set(instanceParams, answer)
+			if err == nil {
+				return nil
+			}
+			fmt.Fprintf(cmd.ErrOrStderr(), "Invalid value: %s\n", err)
+		}
+	}
+}
+
+// preserveParams returns true if the params file of an instance is kept when it is removed. The default
+// can be changed using the PRESERVE_CONFIG_ON_DELETE environment variable, as used by the flow sm-plugin.
+func preserveParams(cmd *cobra.Command) bool {
+	if cmd.Flags().Changed("purge") {
+		purge, _ := cmd.Flags().GetBool("purge")
+		return !purge
+	}
+	switch os.Getenv("PRESERVE_CONFIG_ON_DELETE") {
+	case "", "y", "Y", "YES", "yes", "1":
+		return true
+	}
+	return false
+}
+
+// removeInstanceFolder removes the folder of an instance, except for its params file if it is preserved
+func removeInstanceFolder(dir string, preserve bool) error {
+	if !preserve {
+		return os.RemoveAll(dir)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Name() == params.FileName {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	// The folder is only removed if it is empty, i.e. there are no params to preserve
+	if err := os.Remove(dir); err != nil {
+		slog.Info("Keeping the params of the instance", "path", filepath.Join(dir, params.FileName))
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDeployParams(t *testing.T) {
+	env := newTestEnv(t)
+	for version, template := range map[string]string{
+		"1.0": "debug = false\nlevel = \"info\"\n",
+		"2.0": "debug = false\n",
+	} {
+		tarball := filepath.Join(t.TempDir(), "counter:"+version+".tar")
+		writeTarball(t, tarball, map[string]string{
+			"flow.toml":            testFlow,
+			"lib/main.js":          "// " + version,
+			"params.toml.template": template,
+		})
+		if _, err := env.run(t, "flows", "images", "load", tarball); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The mapper does not read the params of an instance using the file layout
+	if _, err := env.run(t, "flows", "instances", "deploy", "a", "counter:1.0", "--pull", "never", "--param", "debug=true"); err == nil {
+		t.Fatal("expected params to be rejected for the file layout")
+	}
+
+	if _, err := env.run(t, "flows", "instances", "deploy", "a", "counter:1.0", "--pull", "never", "--layout", "dir", "--param", "level=warn"); err != nil {
+		t.Fatal(err)
+	}
+	// The kept params are validated against the params of the new image
+	_, err := env.run(t, "flows", "instances", "deploy", "a", "counter:2.0", "--pull", "never", "--layout", "dir", "--param", "debug=true")
+	if err == nil || !strings.Contains(err.Error(), "level") {
+		t.Fatalf("expected the kept param level to be reported, got %v", err)
+	}
+}
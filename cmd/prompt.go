@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/thin-edge/tedge-oscar/internal/util"
+	"golang.org/x/term"
+)
+
+// isInteractive returns true if the user can be prompted, i.e. stdin is a terminal
+func isInteractive(cmd *cobra.Command) bool {
+	f, ok := cmd.InOrStdin().(*os.File)
+	return ok && util.Isatty(f.Fd())
+}
+
+// promptReader buffers stdin across prompts, so that input typed ahead is not lost
+var promptReader *bufio.Reader
+
+// promptLine asks the user for a line of input, returning it without surrounding whitespace
+func promptLine(cmd *cobra.Command, question string) (string, error) {
+	fmt.Fprint(cmd.ErrOrStderr(), question)
+	if promptReader == nil {
+		promptReader = bufio.NewReader(cmd.InOrStdin())
+	}
+	line, err := promptReader.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// confirm asks the user a yes/no question, defaulting to no
+func confirm(cmd *cobra.Command, question string) (bool, error) {
+	answer, err := promptLine(cmd, question+" [y/N] ")
+	if err != nil {
+		return false, err
+	}
+	switch strings.ToLower(answer) {
+	case "y", "yes":
+		return true, nil
+	}
+	return false, nil
+}
+
+// promptSecret asks the user for a line of input without echoing it, e.g. a token
+func promptSecret(cmd *cobra.Command, question string) (string, error) {
+	f, ok := cmd.InOrStdin().(*os.File)
+	if !ok {
+		return promptLine(cmd, question)
+	}
+	fmt.Fprint(cmd.ErrOrStderr(), question)
+	b, err := term.ReadPassword(int(f.Fd()))
+	fmt.Fprintln(cmd.ErrOrStderr())
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// promptTopics asks the user for the input topics of an instance, which can be picked from the common topics by number
+func promptTopics(cmd *cobra.Command) ([]string, error) {
+	fmt.Fprintln(cmd.ErrOrStderr(), "The flow has no input topics. Common topics:")
+	for i, topic := range commonTopics {
+		name, description, _ := strings.Cut(topic, "\t")
+		fmt.Fprintf(cmd.ErrOrStderr(), "  %2d) %-62s %s\n", i+1, name, description)
+	}
+	for {
+		answer, err := promptLine(cmd, "Input topics (numbers or topics, comma separated): ")
+		if err != nil {
+			return nil, fmt.Errorf("failed to read topics: %w", err)
+		}
+		var topics []string
+		for _, value := range strings.Split(answer, ",") {
+			value = strings.TrimSpace(value)
+			if value == "" {
+				continue
+			}
+			if n, err := strconv.Atoi(value); err == nil {
+				if n < 1 || n > len(commonTopics) {
+					fmt.Fprintf(cmd.ErrOrStderr(), "Invalid topic number: %d\n", n)
+					topics = nil
+					break
+				}
+				value, _, _ = strings.Cut(commonTopics[n-1], "\t")
+			}
+			topics = append(topics, value)
+		}
+		if len(topics) > 0 {
+			return topics, nil
+		}
+	}
+}
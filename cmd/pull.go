@@ -8,14 +8,24 @@ import (
 	"github.com/thin-edge/tedge-oscar/internal/artifact"
 	"github.com/thin-edge/tedge-oscar/internal/config"
 	"github.com/thin-edge/tedge-oscar/internal/imagepull"
+	"github.com/thin-edge/tedge-oscar/internal/imagestore"
 	"github.com/thin-edge/tedge-oscar/internal/registryauth"
 )
 
 var pullCmd = &cobra.Command{
-	Use:     "pull [image]",
-	Short:   "Pull a flow image from an OCI registry",
-	Example: `tedge-oscar flows images pull ghcr.io/thin-edge/connectivity-counter:1.0`,
-	Args:    cobra.ExactArgs(1),
+	Use:   "pull [image]",
+	Short: "Pull a flow image from an OCI registry",
+	Example: `tedge-oscar flows images pull ghcr.io/thin-edge/connectivity-counter:1.0
+
+# Pull the highest 1.4.x version
+tedge-oscar flows images pull "ghcr.io/thin-edge/connectivity-counter:~1.4"`,
+	Args: cobra.ExactArgs(1),
+	ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		if len(args) != 0 {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		return completeImageVersions(cmd, toComplete)
+	},
 	RunE: func(cmd *cobra.Command, args []string) error {
 		// Enable debug HTTP if logLevel is debug
 		registryauth.SetDebugHTTP(logLevel)
@@ -31,26 +41,39 @@ var pullCmd = &cobra.Command{
 		saveAsTarball, _ := cmd.Flags().GetBool("tarball")
 		tarballPath := ""
 
-		imageRef := args[0]
+		imageRef, err := artifact.ParseReference(args[0])
+		if err != nil {
+			return err
+		}
+		if imageRef, err = resolveImageVersion(cmd, cfg, imageRef); err != nil {
+			return err
+		}
 		outputDir, _ := cmd.Flags().GetString("output-dir")
-		name, err := artifact.ParseName(imageRef, false)
+		tarballDir := filepath.Dir(outputDir)
+
+		// The image cache of the image_dir is always used
+		imageDirLock, err := lockImageDir(cmd, cfg)
 		if err != nil {
 			return err
 		}
+		defer imageDirLock.Release()
 
 		if outputDir == "" {
-			outputDir = filepath.Join(cfg.ImageDir, name)
+			store := imagestore.New(cfg.ImageDir)
+			outputDir = store.Path(imageRef)
+			tarballDir = cfg.ImageDir
 		}
 		if saveAsTarball {
-			tarballPath = filepath.Join(filepath.Dir(outputDir), fmt.Sprintf("%s.tar", name))
+			tarballPath = filepath.Join(tarballDir, imageRef.TarballName())
 		}
-		if err := imagepull.PullImage(cfg, imageRef, outputDir, tarballPath, false); err != nil {
+		result, err := imagepull.PullImage(cmd.Context(), cfg, imageRef, outputDir, tarballPath, false)
+		if err != nil {
 			return err
 		}
 		if tarballPath == "" {
-			fmt.Fprintf(cmd.ErrOrStderr(), "Image %s pulled to %s\n", imageRef, outputDir)
+			fmt.Fprintf(cmd.ErrOrStderr(), "Image %s pulled to %s (source: %s, digest: %s)\n", imageRef, outputDir, result.Source.Name(), result.Digest)
 		} else {
-			fmt.Fprintf(cmd.ErrOrStderr(), "Image %s pulled to %s\n", imageRef, tarballPath)
+			fmt.Fprintf(cmd.ErrOrStderr(), "Image %s pulled to %s (source: %s, digest: %s)\n", imageRef, tarballPath, result.Source.Name(), result.Digest)
 		}
 		return nil
 	},
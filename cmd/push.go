@@ -4,6 +4,7 @@ import (
 	"fmt"
 
 	"github.com/spf13/cobra"
+	"github.com/thin-edge/tedge-oscar/internal/artifact"
 	"github.com/thin-edge/tedge-oscar/internal/config"
 	"github.com/thin-edge/tedge-oscar/internal/imagepush"
 	"github.com/thin-edge/tedge-oscar/internal/registryauth"
@@ -25,7 +26,10 @@ var pushCmd = &cobra.Command{
 		if err != nil {
 			return fmt.Errorf("failed to load config: %w", err)
 		}
-		imageRef := args[0]
+		imageRef, err := artifact.ParseReference(args[0])
+		if err != nil {
+			return err
+		}
 		ociType, _ := cmd.Flags().GetString("type")
 		if ociType == "" {
 			ociType = "application/vnd.tedge.flow.v1"
@@ -38,7 +42,7 @@ var pushCmd = &cobra.Command{
 		if rootDir == "" {
 			rootDir = "."
 		}
-		if err := imagepush.PushImage(cfg, imageRef, ociType, files, rootDir); err != nil {
+		if err := imagepush.PushImage(cmd.Context(), cfg, imageRef, ociType, files, rootDir); err != nil {
 			return err
 		}
 		fmt.Fprintf(cmd.ErrOrStderr(), "Image %s pushed to registry as type %s with files: %v (root: %s)\n", imageRef, ociType, files, rootDir)
@@ -1,13 +1,23 @@
 package cmd
 
 import (
+	"context"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/thin-edge/tedge-oscar/internal/lock"
 )
 
 var configPath string
 var logLevel string
+var timeout time.Duration
+var lockTimeout time.Duration
+
+// cancelTimeout releases the timeout context of the command (if any)
+var cancelTimeout context.CancelFunc = func() {}
 
 var rootCmd = &cobra.Command{
 	Use:   "tedge-oscar",
@@ -21,10 +31,28 @@ $ tedge-oscar images pull ghcr.io/thin-edge/connectivity-counter:1.0
 # Deploy a flow instance
 $ tedge-oscar instances deploy myinstance ghcr.io/thin-edge/connectivity-counter:1.0 --topics te/device/main///m/+
 `,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		if timeout > 0 {
+			var ctx context.Context
+			ctx, cancelTimeout = context.WithTimeout(cmd.Context(), timeout)
+			cmd.SetContext(ctx)
+		}
+	},
 }
 
 func Execute() {
-	if err := rootCmd.Execute(); err != nil {
+	// Cancel the running operation on Ctrl-C or when stopped by the service manager,
+	// giving it the chance to remove any partial output
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		// Restore the default behaviour so that a second signal terminates immediately
+		<-ctx.Done()
+		stop()
+	}()
+	err := rootCmd.ExecuteContext(ctx)
+	cancelTimeout()
+	stop()
+	if err != nil {
 		os.Exit(1)
 	}
 }
@@ -33,6 +61,8 @@ func init() {
 	rootCmd.AddCommand(flowsCmd)
 	rootCmd.PersistentFlags().StringVarP(&configPath, "config", "c", "", "Path to config file (overrides default)")
 	rootCmd.PersistentFlags().StringVar(&logLevel, "log-level", "info", "Set the log level (debug, info, warn, error)")
+	rootCmd.PersistentFlags().DurationVar(&timeout, "timeout", 0, "Maximum duration of the command, e.g. 30s or 5m (default: no timeout)")
+	rootCmd.PersistentFlags().DurationVar(&lockTimeout, "lock-timeout", lock.DefaultTimeout, "Maximum time to wait for another tedge-oscar process to release the image_dir or deploy_dir")
 	_ = rootCmd.RegisterFlagCompletionFunc("log-level", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
 		return []string{"debug", "info", "warn", "error"}, cobra.ShellCompDirectiveNoFileComp
 	})
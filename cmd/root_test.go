@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// testEnv is a config using an image_dir and deploy_dir in a temporary folder
+type testEnv struct {
+	ConfigPath string
+	ImageDir   string
+	DeployDir  string
+}
+
+func newTestEnv(t *testing.T) testEnv {
+	t.Helper()
+	dir := t.TempDir()
+	env := testEnv{
+		ConfigPath: filepath.Join(dir, "tedge-oscar.toml"),
+		ImageDir:   filepath.Join(dir, "images"),
+		DeployDir:  filepath.Join(dir, "mappers", "local", "flows"),
+	}
+	cfg := "image_dir = '" + env.ImageDir + "'\n" +
+		"deploy_dir = '" + filepath.Join(dir, "mappers", "{{ .Mapper }}", "flows") + "'\n"
+	if err := os.WriteFile(env.ConfigPath, []byte(cfg), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return env
+}
+
+// run executes a command using the config of the environment, returning its stdout
+func (env testEnv) run(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+	resetFlags(rootCmd)
+	var stdout, stderr bytes.Buffer
+	rootCmd.SetOut(&stdout)
+	rootCmd.SetErr(&stderr)
+	rootCmd.SetIn(strings.NewReader(""))
+	rootCmd.SetArgs(append([]string{"--config", env.ConfigPath}, args...))
+	err := rootCmd.ExecuteContext(context.Background())
+	t.Logf("tedge-oscar %s\n%s", strings.Join(args, " "), stderr.String())
+	return stdout.String(), err
+}
+
+// resetFlags restores the default value of the flags of all commands, as they are kept between executions
+func resetFlags(cmd *cobra.Command) {
+	reset := func(f *pflag.Flag) {
+		if v, ok := f.Value.(pflag.SliceValue); ok {
+			_ = v.Replace(nil)
+		} else {
+			_ = f.Value.Set(f.DefValue)
+		}
+		f.Changed = false
+	}
+	cmd.Flags().VisitAll(reset)
+	cmd.PersistentFlags().VisitAll(reset)
+	for _, sub := range cmd.Commands() {
+		resetFlags(sub)
+	}
+}
+
+// writeTarball writes a flow package with the given files
+func writeTarball(t *testing.T, path string, files map[string]string) {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, contents := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(contents)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(contents)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
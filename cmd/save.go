@@ -5,6 +5,7 @@ import (
 	"os"
 
 	"github.com/spf13/cobra"
+	"github.com/thin-edge/tedge-oscar/internal/artifact"
 	"github.com/thin-edge/tedge-oscar/internal/config"
 	"github.com/thin-edge/tedge-oscar/internal/imagepull"
 )
@@ -29,16 +30,24 @@ var saveCmd = &cobra.Command{
 		if err != nil {
 			return fmt.Errorf("failed to load config: %w", err)
 		}
-		imageRef := args[0]
+		imageRef, err := artifact.ParseReference(args[0])
+		if err != nil {
+			return err
+		}
 		if saveTarballPath == "" {
 			return fmt.Errorf("--output is required")
 		}
+		imageDirLock, err := lockImageDir(cmd, cfg)
+		if err != nil {
+			return err
+		}
+		defer imageDirLock.Release()
 		tmpDir, err := os.MkdirTemp("", "tedge-oscar-save-*")
 		if err != nil {
 			return fmt.Errorf("failed to create temp dir: %w", err)
 		}
 		defer os.RemoveAll(tmpDir)
-		if err := imagepull.PullImage(cfg, imageRef, tmpDir, saveTarballPath, saveCompress); err != nil {
+		if _, err := imagepull.PullImage(cmd.Context(), cfg, imageRef, tmpDir, saveTarballPath, saveCompress); err != nil {
 			return err
 		}
 		fmt.Printf("Image saved to %s\n", saveTarballPath)
@@ -0,0 +1,189 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/spf13/cobra"
+	"github.com/thin-edge/tedge-oscar/internal/artifact"
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/imagestore"
+	"github.com/thin-edge/tedge-oscar/internal/imagetags"
+	"github.com/thin-edge/tedge-oscar/internal/registryauth"
+	"github.com/thin-edge/tedge-oscar/internal/util"
+)
+
+// completionTimeout limits the time spent querying a registry during shell completion
+const completionTimeout = 3 * time.Second
+
+var tagsCmd = &cobra.Command{
+	Use:   "tags [repository]",
+	Short: "List the tags of a flow image in an OCI registry",
+	Example: `# List all tags, newest version first
+$ tedge-oscar flows images tags ghcr.io/thin-edge/connectivity-counter
+
+# List the 1.x versions
+$ tedge-oscar flows images tags ghcr.io/thin-edge/connectivity-counter --constraint "^1"`,
+	Args:         cobra.ExactArgs(1),
+	SilenceUsage: true, // Do not show help on runtime errors
+	RunE: func(cmd *cobra.Command, args []string) error {
+		registryauth.SetDebugHTTP(logLevel)
+		outputFormat, err := cmd.Flags().GetString("output")
+		if err != nil {
+			return err
+		}
+		selectCols, err := cmd.Flags().GetString("select")
+		if err != nil {
+			return err
+		}
+		var colNames []string
+		if selectCols != "" {
+			colNames = strings.Split(selectCols, ",")
+		} else {
+			colNames = []string{"tag", "reference"}
+		}
+		constraint, err := cmd.Flags().GetString("constraint")
+		if err != nil {
+			return err
+		}
+
+		cfgPath := configPath
+		if cfgPath == "" {
+			cfgPath = config.DefaultConfigPath()
+		}
+		cfg, err := config.LoadConfig(cfgPath)
+		if err != nil {
+			return fmt.Errorf("failed to load config: %w", err)
+		}
+		imageRef, err := artifact.ParseReference(args[0])
+		if err != nil {
+			return err
+		}
+		if imageRef.Registry == artifact.LocalRegistry {
+			return fmt.Errorf("image %s was loaded from a tarball and is not stored in a registry", imageRef.Name())
+		}
+		repo, err := registryauth.NewRepository(cfg, imageRef)
+		if err != nil {
+			return err
+		}
+		tags, err := imagetags.List(cmd.Context(), repo)
+		if err != nil {
+			return err
+		}
+		if constraint != "" {
+			if tags, err = imagetags.Filter(tags, constraint); err != nil {
+				return err
+			}
+		}
+		imagetags.Sort(tags)
+
+		rows := [][]string{}
+		for _, tag := range tags {
+			rowMap := map[string]string{
+				"tag":       tag,
+				"reference": imageRef.Name() + ":" + tag,
+			}
+			row := make([]string, len(colNames))
+			for i, col := range colNames {
+				row[i] = rowMap[col]
+			}
+			rows = append(rows, row)
+		}
+		if len(rows) == 0 {
+			fmt.Fprintf(cmd.ErrOrStderr(), "No tags found for %s.\n", imageRef.Name())
+			return nil
+		}
+		return renderRows(cmd.OutOrStdout(), outputFormat, colNames, rows)
+	},
+}
+
+// resolveImageVersion resolves the version constraint of an image reference (if any) to the highest matching tag in the registry
+func resolveImageVersion(cmd *cobra.Command, cfg *config.Config, imageRef artifact.Reference) (artifact.Reference, error) {
+	if imageRef.Constraint == "" {
+		return imageRef, nil
+	}
+	if imageRef.Registry == artifact.LocalRegistry {
+		return imageRef, fmt.Errorf("image %s was loaded from a tarball and is not stored in a registry", imageRef.Name())
+	}
+	repo, err := registryauth.NewRepository(cfg, imageRef)
+	if err != nil {
+		return imageRef, err
+	}
+	resolved, err := imagetags.Resolve(cmd.Context(), repo, imageRef)
+	if err != nil {
+		return imageRef, err
+	}
+	fmt.Fprintf(cmd.ErrOrStderr(), "Resolved %s to %s\n", imageRef, resolved)
+	return resolved, nil
+}
+
+// resolveLocalImageVersion resolves the version constraint of an image reference to the highest matching tag of the locally stored images
+func resolveLocalImageVersion(cmd *cobra.Command, store *imagestore.Store, imageRef artifact.Reference) (artifact.Reference, error) {
+	images, err := store.List()
+	if err != nil {
+		return imageRef, err
+	}
+	tags := []string{}
+	for _, img := range images {
+		if img.Name() == imageRef.Name() && img.Reference.Tag != "" && imagestore.IsComplete(img.Dir) {
+			tags = append(tags, img.Reference.Tag)
+		}
+	}
+	tag, err := imagetags.Latest(tags, imageRef.Constraint)
+	if err != nil {
+		return imageRef, fmt.Errorf("failed to resolve %s using the local images: %w", imageRef, err)
+	}
+	resolved := imageRef
+	resolved.Tag = tag
+	resolved.Constraint = ""
+	fmt.Fprintf(cmd.ErrOrStderr(), "Resolved %s to %s (local image)\n", imageRef, resolved)
+	return resolved, nil
+}
+
+// completeRemoteTags returns the tags of a repository in the registry, newest first, along with
+// constraints matching each major version, e.g. ghcr.io/thin-edge/counter:^1
+func completeRemoteTags(cmd *cobra.Command, cfg *config.Config, name string) []string {
+	imageRef, err := artifact.ParseReference(name)
+	if err != nil || imageRef.Registry == artifact.LocalRegistry {
+		return nil
+	}
+	repo, err := registryauth.NewRepository(cfg, imageRef)
+	if err != nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(cmd.Context(), completionTimeout)
+	defer cancel()
+	tags, err := imagetags.List(ctx, repo)
+	if err != nil {
+		return nil
+	}
+	imagetags.Sort(tags)
+	completions := []string{}
+	majors := map[uint64]bool{}
+	for _, tag := range tags {
+		completions = append(completions, name+":"+tag)
+		if v, err := semver.NewVersion(tag); err == nil && v.Prerelease() == "" && !majors[v.Major()] {
+			majors[v.Major()] = true
+			completions = append(completions, fmt.Sprintf("%s:^%d", name, v.Major()))
+		}
+	}
+	return completions
+}
+
+func init() {
+	defaultOutput := "jsonl"
+	if util.Isatty(os.Stdout.Fd()) {
+		defaultOutput = "table"
+	}
+	tagsCmd.Flags().StringP("output", "o", defaultOutput, "Output format: table|jsonl|tsv")
+	tagsCmd.Flags().String("select", "", "Comma separated list of columns to display (e.g. tag,reference)")
+	tagsCmd.Flags().String("constraint", "", "Only list versions matching a semantic version constraint, e.g. \"^1.2\", \"~1.4\" or \">=1.2, <2\"")
+	_ = tagsCmd.RegisterFlagCompletionFunc("output", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{"table", "jsonl", "tsv"}, cobra.ShellCompDirectiveNoFileComp
+	})
+	imagesCmd.AddCommand(tagsCmd)
+}
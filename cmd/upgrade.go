@@ -0,0 +1,429 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/spf13/cobra"
+	"github.com/thin-edge/tedge-oscar/internal/artifact"
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/imagestore"
+	"github.com/thin-edge/tedge-oscar/internal/lockfile"
+	"github.com/thin-edge/tedge-oscar/internal/params"
+	"github.com/thin-edge/tedge-oscar/internal/util"
+	"github.com/thin-edge/tedge-oscar/pkg/maputil"
+	"github.com/thin-edge/tedge-oscar/pkg/types/flows"
+)
+
+var upgradeInstanceCmd = &cobra.Command{
+	Use:   "upgrade [instance_name] [image]",
+	Short: "Upgrade a deployed flow instance to a new image version",
+	Long: `Upgrade a deployed flow instance to a new image version.
+The instance is rendered again from the flow definition of the new image, keeping the changes
+made to the instance (e.g. the topics, the interval, the step config or hand edits). The changes
+are shown as a diff and applied after confirmation. The params file of the instance is kept as is.
+The files of an instance using the dir layout are copied again from the new image.
+
+If no image is given, the image reference used to deploy the instance is resolved again,
+e.g. a version constraint or a (mutable) tag.`,
+	Example: `# Upgrade an instance to a new version
+$ tedge-oscar flows instances upgrade myinstance ghcr.io/thin-edge/connectivity-counter:1.1
+
+# Upgrade an instance deployed using a version constraint to the highest matching version
+$ tedge-oscar flows instances upgrade myinstance
+
+# Only show the changes
+$ tedge-oscar flows instances upgrade myinstance ghcr.io/thin-edge/connectivity-counter:1.1 --dry-run`,
+	Args:         cobra.RangeArgs(1, 2),
+	SilenceUsage: true, // Do not show help on runtime errors
+	ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		switch len(args) {
+		case 0:
+			return completeInstanceNames(cmd, args, toComplete)
+		case 1:
+			return completeImageVersions(cmd, toComplete)
+		}
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cfgPath := configPath
+		if cfgPath == "" {
+			cfgPath = config.DefaultConfigPath()
+		}
+		cfg, err := config.LoadConfig(cfgPath)
+		if err != nil {
+			return err
+		}
+		instanceName := args[0]
+		topics, err := cmd.Flags().GetStringArray("topics")
+		if err != nil {
+			return err
+		}
+		interval, err := cmd.Flags().GetString("interval")
+		if err != nil {
+			return err
+		}
+		dryRun, err := cmd.Flags().GetBool("dry-run")
+		if err != nil {
+			return err
+		}
+		yes, err := cmd.Flags().GetBool("yes")
+		if err != nil {
+			return err
+		}
+		pullPolicy := cfg.PullPolicy
+		if cmd.Flags().Changed("pull") {
+			pullPolicy, _ = cmd.Flags().GetString("pull")
+			if err := config.ValidatePullPolicy(pullPolicy); err != nil {
+				return err
+			}
+		}
+		mapper := "local"
+		if v, err := cmd.Flags().GetString("mapper"); err == nil {
+			mapper = v
+		}
+		deployDir, err := cfg.GetDeployDir(mapper)
+		if err != nil {
+			return fmt.Errorf("failed to evaluate deployDir: %w", err)
+		}
+		// The deploy_dir is locked before reading the instance, so that it is not changed before it is written
+		deployDirLock, err := lockDeployDir(cmd, deployDir)
+		if err != nil {
+			return err
+		}
+		defer deployDirLock.Release()
+		tomlPath, layout, err := findInstance(deployDir, instanceName)
+		if err != nil {
+			return err
+		}
+		var current map[string]interface{}
+		if _, err := toml.DecodeFile(tomlPath, &current); err != nil {
+			return fmt.Errorf("failed to parse %s: %w", tomlPath, err)
+		}
+		var currentFile flows.InstanceFile
+		if _, err := toml.DecodeFile(tomlPath, &currentFile); err != nil {
+			return fmt.Errorf("failed to parse %s: %w", tomlPath, err)
+		}
+		lf, err := lockfile.Load(deployDir)
+		if err != nil {
+			return err
+		}
+		entry, hasEntry := lf.Instances[instanceName]
+
+		// The image_dir is locked while checking for and pulling the image
+		imageDirLock, err := lockImageDir(cmd, cfg)
+		if err != nil {
+			return err
+		}
+		defer imageDirLock.Release()
+		store := imagestore.New(cfg.ImageDir)
+		var oldImage *imagestore.Image
+		if layout == config.LayoutDir {
+			// The scripts are relative to the instance folder, so the image is the one recorded in the lockfile
+			if hasEntry {
+				oldImage = lockedImage(store, entry)
+			}
+		} else if script := currentFile.Script(); script != "" {
+			if img, err := store.FindImage(script); err == nil && imagestore.IsComplete(img.Dir) {
+				oldImage = &img
+			}
+		}
+
+		var requestedRef artifact.Reference
+		switch {
+		case len(args) == 2:
+			requestedRef, err = artifact.ParseReference(args[1])
+		case hasEntry:
+			requestedRef, err = artifact.ParseReference(entry.Requested)
+		case oldImage != nil && oldImage.Reference.Tag != "":
+			requestedRef = oldImage.Reference
+		default:
+			return fmt.Errorf("the image of instance %s is unknown, please specify the image to upgrade to", instanceName)
+		}
+		if err != nil {
+			return err
+		}
+		pin := hasEntry && entry.Pinned
+		if cmd.Flags().Changed("pin") {
+			pin, _ = cmd.Flags().GetBool("pin")
+		}
+
+		imageRef, imagePath, err := ensureImage(cmd, cfg, store, requestedRef, pullPolicy)
+		if err != nil {
+			return err
+		}
+		if pin {
+			img, err := store.ImageFromDir(imagePath)
+			if err != nil {
+				return err
+			}
+			pinned, err := store.Pin(cmd.Context(), img)
+			if err != nil {
+				return fmt.Errorf("failed to pin image: %w", err)
+			}
+			imageRef.Digest = pinned.Reference.Digest
+			imagePath = pinned.Dir
+		}
+		if layout == config.LayoutFile {
+			// The image_dir stays locked for the dir layout, as the files of the image are copied
+			if err := imageDirLock.Release(); err != nil {
+				return err
+			}
+		}
+
+		// Changes made to the instance are found by comparing it with the instance rendered from the
+		// previous image, and applied to the instance rendered from the new image
+		next, err := renderInstance(imagePath, nil, "")
+		if err != nil {
+			return fmt.Errorf("failed to render instance from image %s: %w", imageRef, err)
+		}
+		if layout == config.LayoutDir {
+			if err := relativeScripts(next, imagePath); err != nil {
+				return err
+			}
+		}
+		// The params of the instance are kept as is, but they may no longer match the params of the new image
+		if instanceParams, err := params.Load(paramsPath(deployDir, instanceName)); err == nil && len(instanceParams) > 0 {
+			if schema, template, err := loadImageParams(imagePath); err == nil {
+				if err := validateParams(instanceParams, schema, template); err != nil {
+					slog.Warn("The params of the instance do not match the params of the new image", "instance", instanceName, "error", err)
+				}
+			}
+		}
+		if current, err = normalizeInstance(current); err != nil {
+			return err
+		}
+		if next, err = normalizeInstance(next); err != nil {
+			return err
+		}
+		if oldImage != nil {
+			relocateScripts(current, *oldImage)
+			base, err := renderInstance(oldImage.Dir, nil, "")
+			if err != nil {
+				return err
+			}
+			if layout == config.LayoutDir {
+				if err := relativeScripts(base, oldImage.Dir); err != nil {
+					return err
+				}
+			}
+			if base, err = normalizeInstance(base); err != nil {
+				return err
+			}
+			maputil.MergeChanges(base, current, next)
+		} else {
+			slog.Warn("The previous image of the instance is no longer available, only the topics, interval, step config and params are kept", "instance", instanceName)
+			carryOverSettings(current, next)
+		}
+		if err := overrideInstance(next, topics, interval); err != nil {
+			return err
+		}
+
+		currentText, err := encodeInstance(current)
+		if err != nil {
+			return err
+		}
+		nextText, err := encodeInstance(next)
+		if err != nil {
+			return err
+		}
+		previous := "<unknown>"
+		if hasEntry {
+			previous = entry.Image
+		} else if oldImage != nil {
+			previous = oldImage.String()
+		}
+		imageDigest := imagestore.ReadAnnotation(imagePath, imagestore.AnnotationDigest)
+		nextEntry := lockfile.Entry{
+			Image:      imageRef.String(),
+			Requested:  requestedRef.String(),
+			Digest:     imageDigest,
+			Source:     imagestore.ReadAnnotation(imagePath, imagestore.AnnotationSource),
+			Pinned:     pin,
+			DeployedAt: time.Now().UTC().Truncate(time.Second),
+		}
+		if schema, _, err := loadImageParams(imagePath); err == nil && schema != nil {
+			nextEntry.Secrets = schema.Secrets()
+		}
+		diff := util.Diff(tomlPath, tomlPath, currentText, nextText)
+		imageChanged := !hasEntry || entry.Digest != imageDigest || entry.Image != nextEntry.Image
+		// The files of an instance using the dir layout are copied from the image, so they change with the image
+		if diff == "" && (layout == config.LayoutFile || !imageChanged) {
+			fmt.Fprintf(cmd.ErrOrStderr(), "Instance %s is already up to date (image: %s, digest: %s)\n", instanceName, imageRef, imageDigest)
+			if dryRun || !imageChanged {
+				return nil
+			}
+			// e.g. a tag which was pulled again as it moved to an image with the same flow definition,
+			// so only the image of the instance is recorded as the instance file stays the same
+			return recordInstance(cfg, deployDir, instanceName, nextEntry, next)
+		}
+		fmt.Fprintf(cmd.ErrOrStderr(), "Upgrading instance %s from %s to %s (digest: %s)\n", instanceName, previous, imageRef, imageDigest)
+		fmt.Fprint(cmd.OutOrStdout(), diff)
+		if dryRun {
+			return nil
+		}
+		if !yes {
+			if !isInteractive(cmd) {
+				return fmt.Errorf("use --yes to upgrade the instance without confirmation")
+			}
+			ok, err := confirm(cmd, "Apply the changes?")
+			if err != nil {
+				return err
+			}
+			if !ok {
+				fmt.Fprintln(cmd.ErrOrStderr(), "Upgrade cancelled.")
+				return nil
+			}
+		}
+
+		if layout == config.LayoutDir {
+			// The params of the instance are kept
+			if _, err := deployInstanceDir(cmd.Context(), deployDir, instanceName, imagePath, next, nil); err != nil {
+				return err
+			}
+			if err := imageDirLock.Release(); err != nil {
+				return err
+			}
+		} else if err := writeInstanceFile(cmd.Context(), tomlPath, next); err != nil {
+			return err
+		}
+		if err := recordInstance(cfg, deployDir, instanceName, nextEntry, next); err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.ErrOrStderr(), "Instance %s upgraded to %s\n", instanceName, imageRef)
+		return nil
+	},
+}
+
+// normalizeInstance round trips an instance through TOML, so that instances which were rendered
+// and instances which were read from a file use the same types and can be compared
+func normalizeInstance(m map[string]interface{}) (map[string]interface{}, error) {
+	text, err := encodeInstance(m)
+	if err != nil {
+		return nil, err
+	}
+	var out map[string]interface{}
+	if _, err := toml.Decode(text, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func encodeInstance(m map[string]interface{}) (string, error) {
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(m); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// lockedImage returns the image recorded in the lockfile entry of an instance, or nil if it is no longer
+// stored with the recorded digest (e.g. the tag was pulled again)
+func lockedImage(store *imagestore.Store, entry lockfile.Entry) *imagestore.Image {
+	ref, err := artifact.ParseReference(entry.Image)
+	if err != nil {
+		return nil
+	}
+	dir, found := store.Lookup(ref)
+	if !found || !imagestore.IsComplete(dir) {
+		return nil
+	}
+	if entry.Digest != "" && imagestore.ReadAnnotation(dir, imagestore.AnnotationDigest) != entry.Digest {
+		return nil
+	}
+	img, err := store.ImageFromDir(dir)
+	if err != nil {
+		return nil
+	}
+	return &img
+}
+
+// relocateScripts replaces the scripts of the steps of an instance which are files of the given image with their
+// path in the image folder, so that a script path which was written differently (e.g. by a deployment made before
+// the image was migrated to the current layout) is not mistaken for a change made to the instance
+func relocateScripts(data map[string]interface{}, img imagestore.Image) {
+	steps, _ := data["steps"].([]map[string]interface{})
+	for _, step := range steps {
+		script, ok := step["script"].(string)
+		if !ok || !filepath.IsAbs(script) {
+			continue
+		}
+		resolved, err := filepath.EvalSymlinks(script)
+		if err != nil {
+			continue
+		}
+		if rel, err := filepath.Rel(img.Dir, resolved); err == nil && filepath.IsLocal(rel) {
+			step["script"] = filepath.Join(img.Dir, rel)
+		}
+	}
+}
+
+// carryOverSettings copies the settings which are commonly changed when deploying an instance
+// (topics, step interval and config, params) to the upgraded instance
+func carryOverSettings(current, next map[string]interface{}) {
+	if topics, ok := lookupValue(current, "input", "mqtt", "topics"); ok {
+		_ = maputil.SetNestedMapValue(next, []string{"input", "mqtt", "topics"}, topics)
+	}
+	if params, ok := current["params"]; ok {
+		next["params"] = params
+	}
+	currentSteps, _ := current["steps"].([]map[string]interface{})
+	nextSteps, _ := next["steps"].([]map[string]interface{})
+	for i := 0; i < len(currentSteps) && i < len(nextSteps); i++ {
+		for _, key := range []string{"interval", "config"} {
+			if v, ok := currentSteps[i][key]; ok {
+				nextSteps[i][key] = v
+			}
+		}
+	}
+}
+
+// overrideInstance sets the topics and the interval of every script step, unless they are empty
+func overrideInstance(m map[string]interface{}, topics []string, interval string) error {
+	if len(topics) > 0 {
+		if err := maputil.SetNestedMapValue(m, []string{"input", "mqtt", "topics"}, topics); err != nil {
+			return fmt.Errorf("failed to set input.mqtt.topics: %w", err)
+		}
+	}
+	if interval != "" {
+		steps, _ := m["steps"].([]map[string]interface{})
+		for _, step := range steps {
+			// The interval only applies to scripts, not to built-in functions of the flows engine
+			if _, ok := step["script"]; ok {
+				step["interval"] = interval
+			}
+		}
+	}
+	return nil
+}
+
+// lookupValue returns the value of a nested key
+func lookupValue(m map[string]interface{}, path ...string) (interface{}, bool) {
+	var v interface{} = m
+	for _, key := range path {
+		nested, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = nested[key]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+func init() {
+	upgradeInstanceCmd.Flags().String("mapper", "local", "Mapper the flow is deployed to")
+	upgradeInstanceCmd.Flags().StringArray("topics", nil, "Input topics (repeatable, optional). Replaces the topics of the instance")
+	upgradeInstanceCmd.Flags().String("interval", "", "Interval in seconds (optional). Replaces the interval of the instance")
+	upgradeInstanceCmd.Flags().Bool("pin", false, "Deploy the image by digest (default: pinned if the instance was pinned)")
+	upgradeInstanceCmd.Flags().String("pull", "", "Pull policy: always|if-not-present|never (default: pull_policy setting of the config, or if-not-present)")
+	upgradeInstanceCmd.Flags().Bool("dry-run", false, "Only show the changes, without upgrading the instance")
+	upgradeInstanceCmd.Flags().BoolP("yes", "y", false, "Upgrade the instance without confirmation")
+	_ = upgradeInstanceCmd.RegisterFlagCompletionFunc("pull", completePullPolicies)
+	instancesCmd.AddCommand(upgradeInstanceCmd)
+}
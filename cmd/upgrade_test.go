@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUpgradeInstanceDeployedBeforeLayoutMigration(t *testing.T) {
+	env := newTestEnv(t)
+	// An image stored and deployed using the legacy <name>:<tag> layout
+	legacyDir := filepath.Join(env.ImageDir, "counter:1.0")
+	if err := os.MkdirAll(filepath.Join(legacyDir, "lib"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(legacyDir, "flow.toml"), []byte("version = \"1.0\"\n"+testFlow), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(legacyDir, "lib", "main.js"), []byte("// 1.0"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(env.DeployDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	instance := "version = \"1.0\"\n" +
+		"input.mqtt.topics = [\"te/device/main///m/+\"]\n\n" +
+		"[[steps]]\n" +
+		"script = '" + filepath.Join(legacyDir, "lib", "main.js") + "'\n"
+	if err := os.WriteFile(filepath.Join(env.DeployDir, "a.toml"), []byte(instance), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Loading the new version migrates the legacy image folder, leaving a link at its old location
+	tarball := filepath.Join(t.TempDir(), "counter:2.0.tar")
+	writeTarball(t, tarball, map[string]string{
+		"flow.toml":   "version = \"2.0\"\n" + testFlow,
+		"lib/main.js": "// 2.0",
+	})
+	if _, err := env.run(t, "flows", "images", "load", tarball); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.run(t, "flows", "instances", "upgrade", "a", "counter:2.0", "--pull", "never", "--yes"); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(env.DeployDir, "a.toml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := filepath.Join(env.ImageDir, "local", "counter", "2.0", "lib", "main.js")
+	if !strings.Contains(string(b), script) {
+		t.Fatalf("upgraded instance does not run the script of the new image. got=%s", b)
+	}
+}
@@ -4,21 +4,23 @@ import (
 	"strings"
 )
 
+// ParseName returns the local image folder name for the given image reference,
+// or only the repository base name if stripVersion is set.
 func ParseName(repoRef string, stripVersion bool) (string, error) {
-	value := repoRef
-	if i := strings.LastIndex(repoRef, "/"); i != -1 {
-		value = repoRef[i+1:]
+	ref, err := ParseReference(repoRef)
+	if err != nil {
+		return "", err
 	}
-
 	if stripVersion {
-		return TrimVersion(value), nil
+		return ref.Base(), nil
 	}
-	return value, nil
+	return ref.FolderName(), nil
 }
 
+// TrimVersion removes the tag or digest from a local image folder name
 func TrimVersion(v string) string {
-	if name, _, found := strings.Cut(v, ":"); found {
-		return name
+	if i := strings.IndexAny(v, ":@"); i != -1 {
+		return v[:i]
 	}
 	return v
 }
@@ -0,0 +1,220 @@
+package artifact
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// DockerHubRegistry is the registry used when a reference does not include one
+	DockerHubRegistry = "docker.io"
+	// DockerHubHost is the host serving the registry API for Docker Hub
+	DockerHubHost = "registry-1.docker.io"
+	// DockerHubLibrary is the namespace used for single segment Docker Hub repositories
+	DockerHubLibrary = "library"
+	// LocalRegistry is the registry name used for images which were not pulled from a registry,
+	// e.g. images loaded from a tarball
+	LocalRegistry = "local"
+)
+
+var (
+	pathComponentRegexp = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|[-]+)[a-z0-9]+)*$`)
+	tagRegexp           = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+)
+
+// Reference is a parsed OCI image reference, e.g. ghcr.io/thin-edge/counter:1.0
+type Reference struct {
+	// Registry is the registry host (including the port), e.g. ghcr.io or localhost:5000
+	Registry string
+	// Repository is the repository path within the registry, e.g. thin-edge/counter
+	Repository string
+	// Tag is the optional tag, e.g. 1.0
+	Tag string
+	// Digest is the optional manifest digest, e.g. sha256:abcd...
+	Digest string
+	// Constraint is an optional semantic version constraint (e.g. ~1.4 or ^2) which
+	// is resolved to the highest matching tag of the repository
+	Constraint string
+}
+
+// ParseReference parses an image reference in the form [registry/]repository[:tag][@digest].
+// References without a registry default to Docker Hub, and single segment Docker Hub
+// repositories are placed in the library namespace (e.g. alpine => docker.io/library/alpine).
+// A semantic version constraint can be given instead of the tag or digest, e.g. counter:~1.4 or counter@^2.
+func ParseReference(s string) (Reference, error) {
+	var ref Reference
+	if s == "" {
+		return ref, fmt.Errorf("image reference is empty")
+	}
+	name := s
+	if i := strings.Index(name, "@"); i != -1 {
+		if v := name[i+1:]; isConstraint(v) {
+			ref.Constraint = v
+		} else {
+			d, err := digest.Parse(v)
+			if err != nil {
+				return ref, fmt.Errorf("invalid digest in image reference %q: %w", s, err)
+			}
+			ref.Digest = d.String()
+		}
+		name = name[:i]
+	}
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		tag := name[i+1:]
+		name = name[:i]
+		switch {
+		case tagRegexp.MatchString(tag):
+			ref.Tag = tag
+		case isConstraint(tag) && ref.Constraint == "":
+			ref.Constraint = tag
+		default:
+			return ref, fmt.Errorf("invalid tag in image reference %q", s)
+		}
+	}
+	if ref.Constraint != "" && (ref.Tag != "" || ref.Digest != "") {
+		return ref, fmt.Errorf("image reference %q can not include both a version constraint and a tag or digest", s)
+	}
+
+	if i := strings.Index(name, "/"); i != -1 && isRegistryHost(name[:i]) {
+		ref.Registry = name[:i]
+		ref.Repository = name[i+1:]
+	} else {
+		ref.Registry = DockerHubRegistry
+		ref.Repository = name
+	}
+	if ref.Registry == "index.docker.io" || ref.Registry == DockerHubHost {
+		ref.Registry = DockerHubRegistry
+	}
+	if ref.Registry == DockerHubRegistry && !strings.Contains(ref.Repository, "/") {
+		ref.Repository = DockerHubLibrary + "/" + ref.Repository
+	}
+
+	if ref.Repository == "" {
+		return ref, fmt.Errorf("image reference %q does not include a repository", s)
+	}
+	for _, component := range strings.Split(ref.Repository, "/") {
+		if !pathComponentRegexp.MatchString(component) {
+			return ref, fmt.Errorf("invalid repository %q in image reference %q (must be lowercase alphanumeric path components)", ref.Repository, s)
+		}
+	}
+	return ref, nil
+}
+
+// isConstraint checks if v is a semantic version constraint rather than a tag or digest.
+// Plain versions (e.g. 1.4) are valid tags, so a constraint must use an operator.
+func isConstraint(v string) bool {
+	if !strings.ContainsAny(v, "~^<>=*, |") {
+		return false
+	}
+	_, err := semver.NewConstraint(v)
+	return err == nil
+}
+
+// isRegistryHost checks if the first path component of a reference is a registry host
+// rather than a Docker Hub namespace.
+func isRegistryHost(v string) bool {
+	return strings.ContainsAny(v, ".:") || v == "localhost" || v == LocalRegistry
+}
+
+// Name returns the fully qualified repository name without the tag or digest, e.g. ghcr.io/thin-edge/counter
+func (r Reference) Name() string {
+	return r.Registry + "/" + r.Repository
+}
+
+// Host returns the registry host to connect to, which differs from the registry name for Docker Hub.
+func (r Reference) Host() string {
+	if r.Registry == DockerHubRegistry {
+		return DockerHubHost
+	}
+	return r.Registry
+}
+
+// Base returns the last path segment of the repository, e.g. counter
+func (r Reference) Base() string {
+	if i := strings.LastIndex(r.Repository, "/"); i != -1 {
+		return r.Repository[i+1:]
+	}
+	return r.Repository
+}
+
+// Reference returns the digest if set, otherwise the tag. This is the value to resolve in the registry.
+func (r Reference) Reference() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+	return r.Tag
+}
+
+// Version returns the tag if set, otherwise the digest.
+func (r Reference) Version() string {
+	if r.Tag != "" {
+		return r.Tag
+	}
+	return r.Digest
+}
+
+// FolderName returns the name of the local image folder, e.g. counter:1.0 or counter@sha256:abcd...
+func (r Reference) FolderName() string {
+	if r.Tag != "" {
+		return r.Base() + ":" + r.Tag
+	}
+	if r.Digest != "" {
+		return r.Base() + "@" + r.Digest
+	}
+	return r.Base()
+}
+
+// String returns the fully qualified reference, e.g. ghcr.io/thin-edge/counter:1.0@sha256:abcd...
+func (r Reference) String() string {
+	s := r.Name()
+	if r.Constraint != "" {
+		s += ":" + r.Constraint
+	}
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
+
+// CopyDestination returns the reference an image is copied to. A destination without a tag or digest gets
+// those of the source, so that an image copied by tag@digest is tagged in the destination as well. The
+// destination is pushed using its Version, i.e. by tag if it has one. A destination with a version constraint
+// is rejected, as it does not name the tag to push.
+func CopyDestination(src Reference, dst Reference) (Reference, error) {
+	if dst.Constraint != "" {
+		return dst, fmt.Errorf("destination image %s has a version constraint, please specify a tag or omit the version", dst)
+	}
+	if dst.Tag == "" && dst.Digest == "" {
+		dst.Tag = src.Tag
+		dst.Digest = src.Digest
+	}
+	return dst, nil
+}
+
+// TarballName returns the file name of the tarball of a pulled image, e.g. counter+1.0.tar.
+// The ':' of the tag or digest is replaced by a '+' (which is not allowed in a reference), as it
+// is not allowed in file names on Windows.
+func (r Reference) TarballName() string {
+	return strings.ReplaceAll(r.FolderName(), ":", "+") + ".tar"
+}
+
+// ReferenceFromTarball derives an image reference from a tarball path or url,
+// e.g. /tmp/counter:1.0.tar.gz or /tmp/counter+1.0.tar.gz => docker.io/library/counter:1.0
+func ReferenceFromTarball(source string) (Reference, error) {
+	name := filepath.Base(source)
+	for _, ext := range []string{".tar.gz", ".tgz", ".tar"} {
+		if strings.HasSuffix(name, ext) {
+			name = strings.TrimSuffix(name, ext)
+			break
+		}
+	}
+	return ParseReference(strings.ReplaceAll(name, "+", ":"))
+}
@@ -0,0 +1,225 @@
+package artifact
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseReference(t *testing.T) {
+	const dgst = "sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+	tests := []struct {
+		name    string
+		input   string
+		expect  Reference
+		folder  string
+		wantErr bool
+	}{
+		{
+			name:   "registry with tag",
+			input:  "ghcr.io/thin-edge/connectivity-counter:1.0",
+			expect: Reference{Registry: "ghcr.io", Repository: "thin-edge/connectivity-counter", Tag: "1.0"},
+			folder: "connectivity-counter:1.0",
+		},
+		{
+			name:   "registry with port",
+			input:  "localhost:5000/flow:1",
+			expect: Reference{Registry: "localhost:5000", Repository: "flow", Tag: "1"},
+			folder: "flow:1",
+		},
+		{
+			name:   "registry with port and no tag",
+			input:  "registry.local:5000/a/b/flow",
+			expect: Reference{Registry: "registry.local:5000", Repository: "a/b/flow"},
+			folder: "flow",
+		},
+		{
+			name:   "tag and digest",
+			input:  "ghcr.io/a/counter:1.0@" + dgst,
+			expect: Reference{Registry: "ghcr.io", Repository: "a/counter", Tag: "1.0", Digest: dgst},
+			folder: "counter:1.0",
+		},
+		{
+			name:   "digest only",
+			input:  "localhost:5000/counter@" + dgst,
+			expect: Reference{Registry: "localhost:5000", Repository: "counter", Digest: dgst},
+			folder: "counter@" + dgst,
+		},
+		{
+			name:   "bare docker hub name",
+			input:  "alpine:3.20",
+			expect: Reference{Registry: "docker.io", Repository: "library/alpine", Tag: "3.20"},
+			folder: "alpine:3.20",
+		},
+		{
+			name:   "docker hub namespace",
+			input:  "thinedge/counter:latest",
+			expect: Reference{Registry: "docker.io", Repository: "thinedge/counter", Tag: "latest"},
+			folder: "counter:latest",
+		},
+		{
+			name:   "docker hub index alias",
+			input:  "index.docker.io/alpine",
+			expect: Reference{Registry: "docker.io", Repository: "library/alpine"},
+			folder: "alpine",
+		},
+		{
+			name:   "local registry",
+			input:  "local/counter:1.0",
+			expect: Reference{Registry: "local", Repository: "counter", Tag: "1.0"},
+			folder: "counter:1.0",
+		},
+		{
+			name:    "empty",
+			input:   "",
+			wantErr: true,
+		},
+		{
+			name:    "uppercase repository",
+			input:   "ghcr.io/Thin-Edge/counter:1.0",
+			wantErr: true,
+		},
+		{
+			name:    "invalid digest",
+			input:   "ghcr.io/a/counter@sha256:1234",
+			wantErr: true,
+		},
+		{
+			name:    "invalid tag",
+			input:   "ghcr.io/a/counter:-1",
+			wantErr: true,
+		},
+		{
+			name:   "tilde constraint",
+			input:  "ghcr.io/acme/counter:~1.4",
+			expect: Reference{Registry: "ghcr.io", Repository: "acme/counter", Constraint: "~1.4"},
+			folder: "counter",
+		},
+		{
+			name:   "caret constraint after @",
+			input:  "ghcr.io/acme/counter@^2",
+			expect: Reference{Registry: "ghcr.io", Repository: "acme/counter", Constraint: "^2"},
+			folder: "counter",
+		},
+		{
+			name:   "range constraint",
+			input:  "localhost:5000/counter:>=1.2 <2",
+			expect: Reference{Registry: "localhost:5000", Repository: "counter", Constraint: ">=1.2 <2"},
+			folder: "counter",
+		},
+		{
+			name:    "constraint and tag",
+			input:   "ghcr.io/acme/counter:1.0@^2",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseReference(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error: %v, got: %v", tt.wantErr, err)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got != tt.expect {
+				t.Errorf("expected reference: %#v, got: %#v", tt.expect, got)
+			}
+			if folder := got.FolderName(); folder != tt.folder {
+				t.Errorf("expected folder name: %s, got: %s", tt.folder, folder)
+			}
+		})
+	}
+}
+
+func TestReferenceString(t *testing.T) {
+	ref, err := ParseReference("alpine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ref.String(); got != "docker.io/library/alpine" {
+		t.Errorf("unexpected string: %s", got)
+	}
+	if got := ref.Host(); got != DockerHubHost {
+		t.Errorf("unexpected host: %s", got)
+	}
+}
+
+func TestReferenceFromTarball(t *testing.T) {
+	ref, err := ReferenceFromTarball("/tmp/images/counter:1.0.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref.FolderName() != "counter:1.0" {
+		t.Errorf("unexpected folder name: %s", ref.FolderName())
+	}
+}
+
+func TestTarballName(t *testing.T) {
+	for _, s := range []string{
+		"ghcr.io/thin-edge/counter:1.0",
+		"ghcr.io/thin-edge/counter@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+	} {
+		ref, err := ParseReference(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := ref.TarballName()
+		if strings.Contains(name, ":") {
+			t.Errorf("tarball name contains a ':'. name=%s", name)
+		}
+		got, err := ReferenceFromTarball("/tmp/images/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.FolderName() != ref.FolderName() {
+			t.Errorf("tarball name does not round trip. got=%s, expected=%s", got.FolderName(), ref.FolderName())
+		}
+	}
+}
+
+func TestCopyDestination(t *testing.T) {
+	const dgst = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	tests := []struct {
+		name    string
+		src     string
+		dst     string
+		expect  string
+		version string
+		wantErr bool
+	}{
+		{name: "tag", src: "dev.example.com/flows/counter:1.0", dst: "ghcr.io/thin-edge/counter", expect: "ghcr.io/thin-edge/counter:1.0", version: "1.0"},
+		{name: "digest", src: "dev.example.com/flows/counter@" + dgst, dst: "ghcr.io/thin-edge/counter", expect: "ghcr.io/thin-edge/counter@" + dgst, version: dgst},
+		{name: "tag and digest", src: "dev.example.com/flows/counter:1.0@" + dgst, dst: "ghcr.io/thin-edge/counter", expect: "ghcr.io/thin-edge/counter:1.0@" + dgst, version: "1.0"},
+		{name: "destination tag", src: "dev.example.com/flows/counter:1.0@" + dgst, dst: "ghcr.io/thin-edge/counter:stable", expect: "ghcr.io/thin-edge/counter:stable", version: "stable"},
+		{name: "destination constraint", src: "dev.example.com/flows/counter:1.0", dst: "ghcr.io/thin-edge/counter:^1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src, err := ParseReference(tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dst, err := ParseReference(tt.dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := CopyDestination(src, dst)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got destination: %s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.String() != tt.expect {
+				t.Errorf("expected destination: %s, got: %s", tt.expect, got)
+			}
+			if got.Version() != tt.version {
+				t.Errorf("expected the destination to be pushed as %s, got: %s", tt.version, got.Version())
+			}
+		})
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"bytes"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"oras.land/oras-go/v2/registry/remote/credentials"
@@ -18,15 +19,110 @@ import (
 //go:embed tedge-oscar.toml
 var embeddedConfig []byte
 
+const (
+	// AuthCredentials authenticates using the registry credentials (default)
+	AuthCredentials = "credentials"
+	// AuthDeviceCert presents the thin-edge.io device certificate as the TLS client certificate
+	AuthDeviceCert = "device-cert"
+)
+
+const (
+	// PullAlways resolves the tag using the registry on every deploy, and pulls the image if its digest changed
+	PullAlways = "always"
+	// PullIfNotPresent only pulls the image if it is not available locally (default)
+	PullIfNotPresent = "if-not-present"
+	// PullNever never contacts the registry, so the image must have been pulled or loaded beforehand
+	PullNever = "never"
+)
+
+const (
+	// LayoutFile deploys an instance as a single <name>.toml file referencing the image in the image_dir (default)
+	LayoutFile = "file"
+	// LayoutDir deploys an instance as a self-contained <name>/flow.toml folder holding a copy of the image files,
+	// as done by the flow sm-plugin
+	LayoutDir = "dir"
+)
+
+// DeployLayouts lists the supported deploy layouts
+var DeployLayouts = []string{LayoutFile, LayoutDir}
+
+// ValidateDeployLayout returns an error if the deploy layout is not supported
+func ValidateDeployLayout(layout string) error {
+	for _, l := range DeployLayouts {
+		if layout == l {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid deploy layout %q, expected one of: %s", layout, strings.Join(DeployLayouts, ", "))
+}
+
+// DefaultHistoryLimit is the number of revisions of each instance which are kept for rollbacks
+const DefaultHistoryLimit = 10
+
+// PullPolicies lists the supported pull policies
+var PullPolicies = []string{PullAlways, PullIfNotPresent, PullNever}
+
+// ValidatePullPolicy returns an error if the pull policy is not supported
+func ValidatePullPolicy(policy string) error {
+	for _, p := range PullPolicies {
+		if policy == p {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid pull policy %q, expected one of: %s", policy, strings.Join(PullPolicies, ", "))
+}
+
 type RegistryCredential struct {
 	Registry string `toml:"registry" json:"registry" yaml:"registry"`
 	Username string `toml:"username" json:"username" yaml:"username"`
 	Password string `toml:"password" json:"password" yaml:"password"`
+	// Auth is the authentication mode of the registry, either credentials (default) or device-cert
+	Auth string `toml:"auth" json:"auth" yaml:"auth"`
+	// Mirrors is an ordered list of mirrors (host[:port][/path-prefix]) to pull images from
+	// before falling back to the registry itself
+	Mirrors []string `toml:"mirrors" json:"mirrors" yaml:"mirrors"`
+	// TrustMirrors allows pulling a tag from the mirrors if the tag can not be resolved using the registry itself
+	// (e.g. the uplink is down), in which case the digest of the image served by a mirror can not be verified
+	TrustMirrors bool `toml:"trust_mirrors" json:"trust_mirrors" yaml:"trust_mirrors"`
+
+	// Transport settings
+	PlainHTTP          bool   `toml:"plain_http" json:"plain_http" yaml:"plain_http"`
+	CAFile             string `toml:"ca_file" json:"ca_file" yaml:"ca_file"`
+	InsecureSkipVerify bool   `toml:"insecure_skip_verify" json:"insecure_skip_verify" yaml:"insecure_skip_verify"`
+	ClientCert         string `toml:"client_cert" json:"client_cert" yaml:"client_cert"`
+	ClientKey          string `toml:"client_key" json:"client_key" yaml:"client_key"`
+	Proxy              string `toml:"proxy" json:"proxy" yaml:"proxy"`
+}
+
+// RetryConfig controls how failed registry requests and interrupted blob downloads are retried
+type RetryConfig struct {
+	// Attempts is the maximum number of retries (0 disables retries)
+	Attempts int `toml:"attempts" json:"attempts" yaml:"attempts"`
+	// MinWait is the wait before the first retry, which is doubled on every subsequent retry
+	MinWait time.Duration `toml:"min_wait" json:"min_wait" yaml:"min_wait"`
+	// MaxWait is the upper limit of the exponential backoff
+	MaxWait time.Duration `toml:"max_wait" json:"max_wait" yaml:"max_wait"`
+	// Jitter is the fraction (0-1) of the wait which is randomised
+	Jitter float64 `toml:"jitter" json:"jitter" yaml:"jitter"`
+}
+
+// DefaultRetryConfig returns the retry settings used if none are configured
+func DefaultRetryConfig() RetryConfig {
+	return RetryConfig{
+		Attempts: 5,
+		MinWait:  500 * time.Millisecond,
+		MaxWait:  30 * time.Second,
+		Jitter:   0.2,
+	}
 }
 
 type Config struct {
 	ImageDir            string               `toml:"image_dir" json:"image_dir" yaml:"image_dir"`
 	DeployDir           string               `toml:"deploy_dir" json:"deploy_dir" yaml:"deploy_dir"`
+	PullPolicy          string               `toml:"pull_policy" json:"pull_policy" yaml:"pull_policy"`
+	DeployLayout        string               `toml:"deploy_layout" json:"deploy_layout" yaml:"deploy_layout"`
+	HistoryLimit        int                  `toml:"history_limit" json:"history_limit" yaml:"history_limit"`
+	Retry               RetryConfig          `toml:"retry" json:"retry" yaml:"retry"`
 	Registries          []RegistryCredential `toml:"registries" json:"registries" yaml:"registries"`
 	UnexpandedImageDir  string               `toml:"-" json:"-" yaml:"-"`
 	UnexpandedDeployDir string               `toml:"-" json:"-" yaml:"-"`
@@ -84,6 +180,41 @@ func (c *Config) GetDeployDir(mapper string) (string, error) {
 	return c.evaluateTemplate(c.DeployDir, mapper)
 }
 
+// DeployDirs returns the existing deploy_dir of every mapper, keyed by the mapper name. The mappers are found
+// by matching the deploy_dir template against the file system, e.g. /etc/tedge/mappers/*/flows.
+// A deploy_dir which does not depend on the mapper is returned for the local mapper.
+func (c *Config) DeployDirs() (map[string]string, error) {
+	// The placeholder can not be part of a path
+	const placeholder = "\x00"
+	pattern, err := c.GetDeployDir(placeholder)
+	if err != nil {
+		return nil, err
+	}
+	dirs := map[string]string{}
+	prefix, _, ok := strings.Cut(pattern, placeholder)
+	if !ok {
+		if info, err := os.Stat(pattern); err == nil && info.IsDir() {
+			dirs["local"] = pattern
+		}
+		return dirs, nil
+	}
+	matches, err := filepath.Glob(strings.ReplaceAll(pattern, placeholder, "*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, match := range matches {
+		mapper, _, _ := strings.Cut(strings.TrimPrefix(match, prefix), string(filepath.Separator))
+		if info, err := os.Stat(match); err != nil || !info.IsDir() {
+			continue
+		}
+		// Skip matches of a pattern with multiple wildcards which do not belong to the mapper
+		if dir, err := c.GetDeployDir(mapper); err == nil && dir == match {
+			dirs[mapper] = match
+		}
+	}
+	return dirs, nil
+}
+
 func expandEnvVars(s string) string {
 	return os.ExpandEnv(s)
 }
@@ -97,18 +228,46 @@ func (c *Config) Expand() {
 		c.Registries[i].Registry = expandEnvVars(c.Registries[i].Registry)
 		c.Registries[i].Username = expandEnvVars(c.Registries[i].Username)
 		c.Registries[i].Password = expandEnvVars(c.Registries[i].Password)
+		c.Registries[i].CAFile = expandEnvVars(c.Registries[i].CAFile)
+		c.Registries[i].ClientCert = expandEnvVars(c.Registries[i].ClientCert)
+		c.Registries[i].ClientKey = expandEnvVars(c.Registries[i].ClientKey)
+		c.Registries[i].Proxy = expandEnvVars(c.Registries[i].Proxy)
+		for j := range c.Registries[i].Mirrors {
+			c.Registries[i].Mirrors[j] = expandEnvVars(c.Registries[i].Mirrors[j])
+		}
+	}
+}
+
+// defaultConfig returns the settings which are used unless they are present in the config file
+func defaultConfig() Config {
+	return Config{
+		PullPolicy:   PullIfNotPresent,
+		DeployLayout: LayoutFile,
+		HistoryLimit: DefaultHistoryLimit,
+		Retry:        DefaultRetryConfig(),
 	}
 }
 
 func loadEmbeddedConfig() (*Config, error) {
-	var cfg Config
+	cfg := defaultConfig()
 	if err := toml.Unmarshal(embeddedConfig, &cfg); err != nil {
 		return &cfg, fmt.Errorf("failed to load embedded config: %w", err)
 	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid embedded config: %w", err)
+	}
 	cfg.Expand()
 	return &cfg, nil
 }
 
+// Validate returns an error if a setting of the config has an unsupported value
+func (c *Config) Validate() error {
+	if err := ValidatePullPolicy(c.PullPolicy); err != nil {
+		return err
+	}
+	return ValidateDeployLayout(c.DeployLayout)
+}
+
 func LoadConfig(path string) (*Config, error) {
 	// Set default tedge config dir
 	if v := os.Getenv("TEDGE_CONFIG_DIR"); v == "" {
@@ -118,14 +277,28 @@ func LoadConfig(path string) (*Config, error) {
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		return loadEmbeddedConfig()
 	}
-	var cfg Config
+	// Defaults are only overwritten by the settings present in the file
+	cfg := defaultConfig()
 	if _, err := toml.DecodeFile(path, &cfg); err != nil {
 		return nil, err
 	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
 	cfg.Expand()
 	return &cfg, nil
 }
 
+// FindRegistry returns the settings of the registry from the config file, or nil if the registry is not configured
+func (c *Config) FindRegistry(registry string) *RegistryCredential {
+	for i := range c.Registries {
+		if c.Registries[i].Registry == registry {
+			return &c.Registries[i]
+		}
+	}
+	return nil
+}
+
 func (c *Config) FindCredential(registry string) *RegistryCredential {
 	// Prefer Docker credentials store if available
 	username, password, err := LoadDockerCredentials(registry)
@@ -139,7 +312,7 @@ func (c *Config) FindCredential(registry string) *RegistryCredential {
 	// Then try ORAS credentials store
 	credStore, err := credentials.NewStore("", credentials.StoreOptions{})
 	if err == nil {
-		cred, err := credStore.Get(context.Background(), registry)
+		cred, err := credStore.Get(context.Background(), credentials.ServerAddressFromRegistry(registry))
 		if err == nil && cred.Username != "" && cred.Password != "" {
 			return &RegistryCredential{
 				Registry: registry,
@@ -0,0 +1,72 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDeployDirs(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"mappers/local/flows", "mappers/c8y/flows", "mappers/aws", "other"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		deployDir string
+		expect    map[string]string
+	}{
+		{
+			deployDir: root + "/mappers/{{ .Mapper }}/flows",
+			expect: map[string]string{
+				"local": filepath.Join(root, "mappers/local/flows"),
+				"c8y":   filepath.Join(root, "mappers/c8y/flows"),
+			},
+		},
+		{
+			deployDir: root + "/other",
+			expect:    map[string]string{"local": root + "/other"},
+		},
+		{
+			deployDir: root + "/missing/{{ .Mapper }}",
+			expect:    map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.deployDir, func(t *testing.T) {
+			cfg := Config{DeployDir: tt.deployDir}
+			got, err := cfg.DeployDirs()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.expect) {
+				t.Errorf("got %v, want %v", got, tt.expect)
+			}
+		})
+	}
+}
+
+func TestLoadConfigValidation(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing.toml")
+	if _, err := LoadConfig(missing); err != nil {
+		t.Fatalf("embedded config is invalid: %v", err)
+	}
+
+	invalid := []byte("pull_policy = \"sometimes\"\n")
+	path := filepath.Join(t.TempDir(), "tedge-oscar.toml")
+	if err := os.WriteFile(path, invalid, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(path); err == nil {
+		t.Error("invalid config file was accepted")
+	}
+
+	saved := embeddedConfig
+	defer func() { embeddedConfig = saved }()
+	embeddedConfig = []byte("deploy_layout = \"tree\"\n")
+	if _, err := LoadConfig(missing); err == nil {
+		t.Error("invalid embedded config was accepted")
+	}
+}
@@ -13,7 +13,7 @@ func LoadDockerCredentials(registry string) (username, password string, err erro
 	if err != nil {
 		return "", "", err
 	}
-	cred, err := credStore.Get(context.Background(), registry)
+	cred, err := credStore.Get(context.Background(), credentials.ServerAddressFromRegistry(registry))
 	if err != nil {
 		return "", "", err
 	}
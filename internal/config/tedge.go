@@ -0,0 +1,49 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/BurntSushi/toml"
+)
+
+// TedgeDevice is the device section of the thin-edge.io configuration (tedge.toml)
+type TedgeDevice struct {
+	CertPath string `toml:"cert_path"`
+	KeyPath  string `toml:"key_path"`
+}
+
+type tedgeConfig struct {
+	Device TedgeDevice `toml:"device"`
+}
+
+// LoadTedgeDevice reads the device certificate settings from the thin-edge.io configuration
+// ($TEDGE_CONFIG_DIR/tedge.toml). The settings can be overridden by the TEDGE_DEVICE_CERT_PATH
+// and TEDGE_DEVICE_KEY_PATH environment variables, and fall back to the thin-edge.io defaults.
+func LoadTedgeDevice() (*TedgeDevice, error) {
+	configDir := os.Getenv("TEDGE_CONFIG_DIR")
+	if configDir == "" {
+		configDir = "/etc/tedge"
+	}
+	var cfg tedgeConfig
+	path := filepath.Join(configDir, "tedge.toml")
+	if _, err := os.Stat(path); err == nil {
+		if _, err := toml.DecodeFile(path, &cfg); err != nil {
+			return nil, err
+		}
+	}
+	device := cfg.Device
+	if v := os.Getenv("TEDGE_DEVICE_CERT_PATH"); v != "" {
+		device.CertPath = v
+	}
+	if v := os.Getenv("TEDGE_DEVICE_KEY_PATH"); v != "" {
+		device.KeyPath = v
+	}
+	if device.CertPath == "" {
+		device.CertPath = filepath.Join(configDir, "device-certs", "tedge-certificate.pem")
+	}
+	if device.KeyPath == "" {
+		device.KeyPath = filepath.Join(configDir, "device-certs", "tedge-private-key.pem")
+	}
+	return &device, nil
+}
@@ -0,0 +1,110 @@
+package history
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/BurntSushi/toml"
+
+	"github.com/thin-edge/tedge-oscar/internal/lockfile"
+	"github.com/thin-edge/tedge-oscar/internal/util"
+)
+
+// Dir is the folder inside a deploy_dir holding the history of each instance. The history files do not
+// use the .toml extension, so that they are not mistaken for instances.
+const Dir = ".history"
+
+// Revision is a deployment of an instance
+type Revision struct {
+	// Revision is the number of the revision, starting from 1
+	Revision int `toml:"revision" json:"revision"`
+	lockfile.Entry
+	// Instance is the content of the instance file
+	Instance string `toml:"instance" json:"-"`
+}
+
+// History lists the revisions of an instance, oldest first. The last revision is the current one.
+type History struct {
+	Revisions []Revision `toml:"revisions" json:"revisions"`
+}
+
+// Path returns the history file of an instance
+func Path(deployDir string, name string) string {
+	return filepath.Join(deployDir, Dir, name+".history")
+}
+
+// Load reads the history of an instance. A missing history is treated as empty.
+func Load(deployDir string, name string) (*History, error) {
+	h := &History{}
+	path := Path(deployDir, name)
+	if _, err := toml.DecodeFile(path, h); err != nil {
+		if os.IsNotExist(err) {
+			return h, nil
+		}
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return h, nil
+}
+
+// Save writes the history of an instance
+func (h *History) Save(deployDir string, name string) error {
+	path := Path(deployDir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(path, 0644, func(w io.Writer) error {
+		return toml.NewEncoder(w).Encode(h)
+	})
+}
+
+// Add appends a revision, dropping the oldest revisions beyond the limit
+func (h *History) Add(entry lockfile.Entry, instance string, limit int) Revision {
+	rev := Revision{Revision: 1, Entry: entry, Instance: instance}
+	if current, ok := h.Current(); ok {
+		rev.Revision = current.Revision + 1
+	}
+	h.Revisions = append(h.Revisions, rev)
+	if limit > 0 && len(h.Revisions) > limit {
+		h.Revisions = h.Revisions[len(h.Revisions)-limit:]
+	}
+	return rev
+}
+
+// Current returns the current (last) revision
+func (h *History) Current() (Revision, bool) {
+	if len(h.Revisions) == 0 {
+		return Revision{}, false
+	}
+	return h.Revisions[len(h.Revisions)-1], true
+}
+
+// Get returns the revision with the given number
+func (h *History) Get(revision int) (Revision, bool) {
+	for _, rev := range h.Revisions {
+		if rev.Revision == revision {
+			return rev, true
+		}
+	}
+	return Revision{}, false
+}
+
+// Previous returns the revision before the current one
+func (h *History) Previous() (Revision, bool) {
+	if len(h.Revisions) < 2 {
+		return Revision{}, false
+	}
+	return h.Revisions[len(h.Revisions)-2], true
+}
+
+// Remove removes the history of an instance
+func Remove(deployDir string, name string) error {
+	path := Path(deployDir, name)
+	for _, p := range []string{path, path + util.BackupSuffix} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
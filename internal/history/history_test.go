@@ -0,0 +1,57 @@
+package history
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/thin-edge/tedge-oscar/internal/lockfile"
+)
+
+func TestHistory(t *testing.T) {
+	dir := t.TempDir()
+	h, err := Load(dir, "counter")
+	if err != nil {
+		t.Fatalf("missing history: %v", err)
+	}
+	if _, ok := h.Current(); ok {
+		t.Fatal("expected no current revision")
+	}
+	for i, version := range []string{"1.0", "1.1", "1.2", "1.3"} {
+		entry := lockfile.Entry{
+			Image:      "ghcr.io/thin-edge/counter:" + version,
+			Requested:  "ghcr.io/thin-edge/counter:" + version,
+			DeployedAt: time.Date(2025, 3, 1, i, 0, 0, 0, time.UTC),
+		}
+		rev := h.Add(entry, "[[steps]]\nscript = \""+version+"/lib/main.js\"\n", 3)
+		if rev.Revision != i+1 {
+			t.Errorf("got revision %d, want %d", rev.Revision, i+1)
+		}
+	}
+	if len(h.Revisions) != 3 {
+		t.Fatalf("expected the history to be limited to 3 revisions, got %d", len(h.Revisions))
+	}
+	if _, ok := h.Get(1); ok {
+		t.Error("expected the oldest revision to be dropped")
+	}
+	if rev, ok := h.Previous(); !ok || rev.Revision != 3 || rev.Image != "ghcr.io/thin-edge/counter:1.2" {
+		t.Errorf("unexpected previous revision: %+v", rev)
+	}
+
+	if err := h.Save(dir, "counter"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Load(dir, "counter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, h) {
+		t.Errorf("got %+v, want %+v", got, h)
+	}
+	if err := Remove(dir, "counter"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := Load(dir, "counter"); err != nil || len(got.Revisions) != 0 {
+		t.Errorf("expected the history to be removed, got %+v (%v)", got, err)
+	}
+}
@@ -0,0 +1,205 @@
+package imageinspect
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/registry/remote"
+
+	"github.com/thin-edge/tedge-oscar/internal/imagestore"
+)
+
+// maxConfigSize is the maximum size of a config blob which is included in the output
+const maxConfigSize = 64 * 1024
+
+// Info describes the manifest of an image
+type Info struct {
+	Reference    string            `json:"reference"`
+	Location     string            `json:"location"`
+	Path         string            `json:"path,omitempty"`
+	Digest       string            `json:"digest,omitempty"`
+	MediaType    string            `json:"mediaType,omitempty"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	Config       *Config           `json:"config,omitempty"`
+	Layers       []Layer           `json:"layers,omitempty"`
+	// Manifests lists the manifests of an image index
+	Manifests []ocispec.Descriptor `json:"manifests,omitempty"`
+	// Files lists the files of a local image which has no stored manifest (e.g. an image loaded from a flow package)
+	Files []File `json:"files,omitempty"`
+	// NoManifest is set if the image has no stored manifest, so only its files are known
+	NoManifest bool `json:"noManifest,omitempty"`
+}
+
+// File describes a file of a local image which has no stored manifest
+type File struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// Config describes the config blob of an image. The content is included if it is JSON.
+type Config struct {
+	MediaType string          `json:"mediaType"`
+	Digest    string          `json:"digest"`
+	Size      int64           `json:"size"`
+	Data      json.RawMessage `json:"data,omitempty"`
+}
+
+// Layer describes a file of an image
+type Layer struct {
+	Title     string `json:"title"`
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+}
+
+// Location of the inspected image
+const (
+	LocationRegistry = "registry"
+	LocationLocal    = "local"
+)
+
+// manifest is the union of the fields of an image manifest and an image index
+type manifest struct {
+	MediaType    string               `json:"mediaType"`
+	ArtifactType string               `json:"artifactType,omitempty"`
+	Config       *ocispec.Descriptor  `json:"config,omitempty"`
+	Layers       []ocispec.Descriptor `json:"layers,omitempty"`
+	Manifests    []ocispec.Descriptor `json:"manifests,omitempty"`
+	Annotations  map[string]string    `json:"annotations,omitempty"`
+}
+
+// Remote inspects an image in a registry without pulling it
+func Remote(ctx context.Context, repo *remote.Repository, reference string, name string) (*Info, error) {
+	desc, err := repo.Resolve(ctx, reference)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", name, err)
+	}
+	manifestBytes, err := content.FetchAll(ctx, repo, desc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch manifest: %w", err)
+	}
+	info, m, err := parse(manifestBytes)
+	if err != nil {
+		return nil, err
+	}
+	info.Reference = name
+	info.Location = LocationRegistry
+	info.Digest = desc.Digest.String()
+	if info.MediaType == "" {
+		info.MediaType = desc.MediaType
+	}
+	if m.Config != nil {
+		info.Config.Data = fetchConfig(ctx, repo, *m.Config)
+	}
+	return info, nil
+}
+
+// Local inspects an image from the manifest stored in its image folder. The config
+// is read from the image cache (if present). Images without a stored manifest are
+// described by the files of their image folder.
+func Local(ctx context.Context, store *imagestore.Store, img imagestore.Image) (*Info, error) {
+	manifestBytes, err := os.ReadFile(filepath.Join(img.Dir, imagestore.ManifestFile))
+	if os.IsNotExist(err) {
+		return localFiles(img)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	info, m, err := parse(manifestBytes)
+	if err != nil {
+		return nil, err
+	}
+	info.Reference = img.String()
+	info.Location = LocationLocal
+	info.Path = img.Dir
+	info.Digest = info.Annotations[imagestore.AnnotationDigest]
+	if m.Config != nil {
+		if _, err := os.Stat(filepath.Join(store.Root, imagestore.CacheDir)); err == nil {
+			if cache, err := store.Cache(ctx); err == nil {
+				info.Config.Data = fetchConfig(ctx, cache, *m.Config)
+			}
+		}
+	}
+	return info, nil
+}
+
+// localFiles describes a local image which has no stored manifest by the files of its image folder
+func localFiles(img imagestore.Image) (*Info, error) {
+	info := &Info{
+		Reference:  img.String(),
+		Location:   LocationLocal,
+		Path:       img.Dir,
+		NoManifest: true,
+	}
+	err := filepath.WalkDir(img.Dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || path == filepath.Join(img.Dir, imagestore.CompleteFile) {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(img.Dir, path)
+		if err != nil {
+			return err
+		}
+		info.Files = append(info.Files, File{Name: filepath.ToSlash(rel), Size: fi.Size()})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image folder: %w", err)
+	}
+	return info, nil
+}
+
+func parse(manifestBytes []byte) (*Info, *manifest, error) {
+	var m manifest
+	if err := json.Unmarshal(manifestBytes, &m); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	info := &Info{
+		MediaType:    m.MediaType,
+		ArtifactType: m.ArtifactType,
+		Annotations:  m.Annotations,
+		Manifests:    m.Manifests,
+	}
+	if m.Config != nil {
+		info.Config = &Config{
+			MediaType: m.Config.MediaType,
+			Digest:    m.Config.Digest.String(),
+			Size:      m.Config.Size,
+		}
+	}
+	for _, layer := range m.Layers {
+		info.Layers = append(info.Layers, Layer{
+			Title:     layer.Annotations[ocispec.AnnotationTitle],
+			MediaType: layer.MediaType,
+			Digest:    layer.Digest.String(),
+			Size:      layer.Size,
+		})
+	}
+	return info, &m, nil
+}
+
+// fetchConfig returns the content of a config blob if it is (small) JSON, otherwise nil
+func fetchConfig(ctx context.Context, fetcher content.Fetcher, desc ocispec.Descriptor) json.RawMessage {
+	if desc.Size == 0 || desc.Size > maxConfigSize || !strings.HasSuffix(desc.MediaType, "json") {
+		return nil
+	}
+	data, err := content.FetchAll(ctx, fetcher, desc)
+	if err != nil || !json.Valid(data) {
+		return nil
+	}
+	return data
+}
@@ -1,27 +1,36 @@
 package imagepull
 
 import (
-	"archive/tar"
 	"compress/gzip"
+	"context"
 	"fmt"
 	"io"
-	"log/slog"
 	"net/http"
 	"os"
-	"path/filepath"
 	"strings"
+
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/imagestore"
+	"github.com/thin-edge/tedge-oscar/internal/util"
 )
 
 // LoadTarballImage loads a flow image from a tarball, either from a URL or a local file path, and extracts it to outputDir.
-func LoadTarballImage(source string, outputDir string) error {
+// The image is only moved to outputDir once it is complete, so a failed or cancelled load leaves any existing image untouched.
+// An outputDir outside of the image_dir is never replaced, the files of the image are merged into it.
+func LoadTarballImage(ctx context.Context, cfg *config.Config, source string, outputDir string) error {
 	var reader io.ReadCloser
 	var err error
 	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
-		resp, err := http.Get(source)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+		if err != nil {
+			return fmt.Errorf("failed to download tarball: %w", err)
+		}
+		resp, err := http.DefaultClient.Do(req)
 		if err != nil {
 			return fmt.Errorf("failed to download tarball: %w", err)
 		}
 		if resp.StatusCode != 200 {
+			resp.Body.Close()
 			return fmt.Errorf("failed to download tarball: status %d", resp.StatusCode)
 		}
 		reader = resp.Body
@@ -32,6 +41,7 @@ func LoadTarballImage(source string, outputDir string) error {
 		}
 	}
 	defer reader.Close()
+	reader = util.NewContextReader(ctx, reader)
 
 	// Handle gzip compression if needed
 	if strings.HasSuffix(source, ".gz") {
@@ -43,35 +53,13 @@ func LoadTarballImage(source string, outputDir string) error {
 		reader = gzReader
 	}
 
-	tr := tar.NewReader(reader)
-	for {
-		hdr, err := tr.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return fmt.Errorf("error reading tarball: %w", err)
-		}
-		if hdr.Typeflag != tar.TypeReg {
-			continue // skip non-regular files
-		}
-		if strings.Contains(hdr.Name, "..") {
-			slog.Warn("Skipping file as it uses '..' within the path. This is not allowed to prevent path traversal attacks.", "name", hdr.Name)
-			continue
-		}
-		outPath := filepath.Join(outputDir, hdr.Name)
-		if err := os.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
-			return fmt.Errorf("failed to create directory: %w", err)
-		}
-		outFile, err := os.Create(outPath)
-		if err != nil {
-			return fmt.Errorf("failed to create file: %w", err)
-		}
-		if _, err := io.Copy(outFile, tr); err != nil {
-			outFile.Close()
-			return fmt.Errorf("failed to extract file: %w", err)
-		}
-		outFile.Close()
+	staging, err := imagestore.Stage(outputDir)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+	if err := util.ExtractTar(reader, staging); err != nil {
+		return err
 	}
-	return nil
+	return commitImage(imagestore.New(cfg.ImageDir), staging, outputDir, imagestore.ReadAnnotation(staging, imagestore.AnnotationDigest))
 }
@@ -4,170 +4,284 @@ import (
 	"archive/tar"
 	"compress/gzip"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
 
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"oras.land/oras-go/v2"
-	"oras.land/oras-go/v2/content/file"
-	"oras.land/oras-go/v2/registry/remote"
 
+	"github.com/thin-edge/tedge-oscar/internal/artifact"
 	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/imagestore"
 	"github.com/thin-edge/tedge-oscar/internal/registryauth"
 )
 
-// PullImage pulls an OCI artifact and stores its contents in outputDir.
-func PullImage(cfg *config.Config, imageRef string, outputDir string, tarballPath string, compress bool) error {
-	repoRef, ref := imageRef, ""
-	if i := strings.LastIndex(imageRef, ":"); i > strings.LastIndex(imageRef, "/") {
-		repoRef = imageRef[:i]
-		ref = imageRef[i+1:]
-	} else if i := strings.LastIndex(imageRef, "@"); i > strings.LastIndex(imageRef, "/") {
-		repoRef = imageRef[:i]
-		ref = imageRef[i+1:]
-	}
-	if repoRef == imageRef || ref == "" {
-		return fmt.Errorf("image reference must include a tag or digest, e.g. ghcr.io/user/repo:tag or @sha256:<hash>")
-	}
-	store, err := file.New(outputDir)
-	if err != nil {
-		return fmt.Errorf("failed to open image dir: %w", err)
-	}
-	repo, err := remote.NewRepository(repoRef)
-	if err != nil {
-		return fmt.Errorf("invalid repository: %w", err)
+// PullResult describes where an image was pulled from
+type PullResult struct {
+	// Source is the repository the image was pulled from, either the registry or one of its mirrors
+	Source artifact.Reference
+	// Digest is the manifest digest of the pulled image
+	Digest string
+}
+
+// PullImage pulls an OCI artifact into the image cache of the image_dir and stores its contents in outputDir.
+// The mirrors of the registry are tried in order before falling back to the registry itself.
+// The image is only moved to outputDir once it is complete, so a failed or cancelled pull leaves any existing image
+// untouched. A partially written tarball is removed. An outputDir outside of the image_dir is never replaced, the
+// files of the image are merged into it.
+func PullImage(ctx context.Context, cfg *config.Config, imageRef artifact.Reference, outputDir string, tarballPath string, compress bool) (*PullResult, error) {
+	ref := imageRef.Reference()
+	if imageRef.Constraint != "" {
+		return nil, fmt.Errorf("the version constraint of %s must be resolved before pulling", imageRef)
 	}
-	// Use shared registry auth logic
-	client, _, _, _, err := registryauth.GetAuthenticatedClient(cfg, repoRef, "")
-	if err != nil {
-		return fmt.Errorf("auth error: %w", err)
+	if ref == "" {
+		return nil, fmt.Errorf("image reference must include a tag or digest, e.g. ghcr.io/user/repo:tag or @sha256:<hash>")
 	}
-	if client != nil {
-		repo.Client = client
+	if imageRef.Registry == artifact.LocalRegistry {
+		return nil, fmt.Errorf("image %s was loaded from a tarball and can not be pulled from a registry", imageRef)
 	}
-	// Pull the image and get the manifest descriptor
-	desc, err := oras.Copy(context.Background(), repo, ref, store, "", oras.DefaultCopyOptions)
-	if err != nil {
-		return fmt.Errorf("oras pull failed: %w", err)
+	sources := []artifact.Reference{}
+	trustMirrors := false
+	if reg := cfg.FindRegistry(imageRef.Registry); reg != nil {
+		for _, mirror := range reg.Mirrors {
+			sources = append(sources, mirrorReference(mirror, imageRef))
+		}
+		trustMirrors = reg.TrustMirrors
 	}
 
-	if tarballPath != "" {
-		// Save manifest.json to outputDir first (same as pull)
-		manifestBytes, err := store.Fetch(context.Background(), desc)
-		if err == nil {
-			manifestPath := filepath.Join(outputDir, "manifest.json")
-			var data []byte
-			rc := manifestBytes
-			defer rc.Close()
-			data, err = io.ReadAll(rc)
-			if err != nil {
-				data = nil
-			}
-			if data != nil {
-				var manifest map[string]any
-				if err := json.Unmarshal(data, &manifest); err == nil {
-					ann, ok := manifest["annotations"].(map[string]any)
-					if !ok {
-						ann = make(map[string]any)
-					}
-					if _, hasVersion := ann["org.opencontainers.image.version"]; !hasVersion && ref != "" {
-						ann["org.opencontainers.image.version"] = ref
-					}
-					manifest["annotations"] = ann
-					if newData, err := json.MarshalIndent(manifest, "", "  "); err == nil {
-						data = newData
-					}
-				}
-				_ = os.WriteFile(manifestPath, data, 0644)
+	// The expected digest is used to verify the content served by a mirror. If the digest is not part of the
+	// reference, then the tag is resolved using the registry itself. Mirrors are only used if the digest is known,
+	// as a mirror could otherwise serve a different image for the same tag, unless the mirrors are trusted.
+	expectedDigest := imageRef.Digest
+	if expectedDigest == "" && len(sources) > 0 {
+		dgst, err := resolveTag(ctx, cfg, imageRef)
+		if err != nil {
+			if trustMirrors {
+				slog.Warn("Could not resolve the tag using the registry, pulling the tag from the trusted mirrors without verifying its digest", "reference", imageRef, "error", err)
+			} else {
+				slog.Warn("Could not resolve the tag using the registry, so the mirrors are not used as the digest of the image can not be verified (see trust_mirrors)", "reference", imageRef, "error", err)
+				sources = sources[:0]
 			}
 		}
-		// Save as tarball (with optional compression)
-		var out io.WriteCloser
-		out, err = os.Create(tarballPath)
+		expectedDigest = dgst
+	}
+	sources = append(sources, imageRef)
+
+	// Pull the image into the cache (blobs which are already cached are skipped)
+	store := imagestore.New(cfg.ImageDir)
+	cache, err := store.Cache(ctx)
+	if err != nil {
+		return nil, err
+	}
+	srcRef := ref
+	if expectedDigest != "" {
+		// Pulling by digest guarantees that the content matches the digest
+		srcRef = expectedDigest
+	}
+	var result *PullResult
+	var manifestDesc ocispec.Descriptor
+	var pullErrs []error
+	for _, source := range sources {
+		repo, err := registryauth.NewRepository(cfg, source)
 		if err != nil {
-			return fmt.Errorf("failed to create tarball: %w", err)
+			pullErrs = append(pullErrs, err)
+			continue
 		}
-		defer out.Close()
-		var tw *tar.Writer
-		if compress {
-			gz := gzip.NewWriter(out)
-			defer gz.Close()
-			tw = tar.NewWriter(gz)
-			defer tw.Close()
-		} else {
-			tw = tar.NewWriter(out)
-			defer tw.Close()
-		}
-		// Walk outputDir and add files to tarball (including manifest.json)
-		addToTar := func(path string, info os.DirEntry, err error) error {
-			if err != nil {
-				return err
-			}
-			if info.IsDir() {
-				return nil
-			}
-			f, err := os.Open(path)
-			if err != nil {
-				return err
-			}
-			defer f.Close()
-			stat, err := f.Stat()
-			if err != nil {
-				return err
-			}
-			hdr := &tar.Header{
-				Name: strings.TrimPrefix(path, outputDir+string(os.PathSeparator)),
-				Size: stat.Size(),
-				Mode: int64(stat.Mode()),
+		if err := fetchBlobs(ctx, cfg.Retry, repo, srcRef, store, cache); err != nil {
+			if ctx.Err() != nil {
+				return nil, err
 			}
-			if err := tw.WriteHeader(hdr); err != nil {
-				return err
-			}
-			if _, err := io.Copy(tw, f); err != nil {
-				return err
+			slog.Warn("Failed to pull image", "source", source.Name(), "error", err)
+			pullErrs = append(pullErrs, fmt.Errorf("%s: %w", source.Name(), err))
+			continue
+		}
+		desc, err := oras.Copy(ctx, repo, srcRef, cache, imagestore.CacheTag(imageRef), oras.DefaultCopyOptions)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
 			}
-			return nil
+			slog.Warn("Failed to pull image", "source", source.Name(), "error", err)
+			pullErrs = append(pullErrs, fmt.Errorf("%s: %w", source.Name(), err))
+			continue
 		}
-		if err := filepath.WalkDir(outputDir, addToTar); err != nil {
-			return fmt.Errorf("failed to create tarball: %w", err)
+		result = &PullResult{
+			Source: source,
+			Digest: desc.Digest.String(),
 		}
-		return nil
+		manifestDesc = desc
+		break
+	}
+	if result == nil {
+		return nil, fmt.Errorf("oras pull failed: %w", errors.Join(pullErrs...))
+	}
+
+	// The image is assembled in a staging folder and only moved into place once it is complete
+	staging, err := imagestore.Stage(outputDir)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging)
+	annotations := map[string]string{
+		imagestore.AnnotationSource: result.Source.Name(),
+	}
+	if err := imagestore.Materialise(ctx, cache, manifestDesc, staging, imageRef, annotations); err != nil {
+		return nil, fmt.Errorf("failed to extract image: %w", err)
+	}
+	// The tarball only contains the files of the image, even if outputDir has other files
+	if tarballPath != "" {
+		if err := writeTarball(ctx, staging, tarballPath, compress); err != nil {
+			_ = os.Remove(tarballPath)
+			return nil, err
+		}
+	}
+	if err := commitImage(store, staging, outputDir, result.Digest); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// commitImage moves an assembled image into place. Image folders of the store are replaced, while the files
+// of the image are merged into any other folder, so that the unrelated files of a user given folder are kept.
+func commitImage(store *imagestore.Store, staging string, dest string, digest string) error {
+	if store.IsImagePath(dest) {
+		return imagestore.Commit(staging, dest, digest)
+	}
+	if err := imagestore.Merge(staging, dest); err != nil {
+		return err
+	}
+	// A folder of the image_dir which did not hold an image before (e.g. an empty folder) holds one now
+	if store.IsImagePath(dest) {
+		return imagestore.MarkComplete(dest, digest)
 	}
+	return nil
+}
 
-	// Save the manifest JSON to the image folder
-	manifestBytes, err := store.Fetch(context.Background(), desc)
-	if err == nil {
-		manifestPath := filepath.Join(outputDir, "manifest.json")
-		var data []byte
-		// manifestBytes is already io.ReadCloser
-		rc := manifestBytes
-		defer rc.Close()
-		data, err = io.ReadAll(rc)
+// ResolveDigest returns the manifest digest of an image in the registry, falling back to the mirrors of
+// the registry if it is not reachable. A reference which already includes a digest is returned as is.
+func ResolveDigest(ctx context.Context, cfg *config.Config, imageRef artifact.Reference) (string, error) {
+	if imageRef.Digest != "" {
+		return imageRef.Digest, nil
+	}
+	if imageRef.Registry == artifact.LocalRegistry {
+		return "", fmt.Errorf("image %s was loaded from a tarball and can not be resolved using a registry", imageRef)
+	}
+	if imageRef.Tag == "" {
+		return "", fmt.Errorf("image reference must include a tag or digest, e.g. ghcr.io/user/repo:tag or @sha256:<hash>")
+	}
+	sources := []artifact.Reference{imageRef}
+	if reg := cfg.FindRegistry(imageRef.Registry); reg != nil {
+		for _, mirror := range reg.Mirrors {
+			sources = append(sources, mirrorReference(mirror, imageRef))
+		}
+	}
+	var errs []error
+	for _, source := range sources {
+		repo, err := registryauth.NewRepository(cfg, source)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		desc, err := repo.Resolve(ctx, imageRef.Tag)
 		if err != nil {
-			data = nil
-		}
-		if data != nil {
-			// Try to add version if not present
-			var manifest map[string]any
-			if err := json.Unmarshal(data, &manifest); err == nil {
-				ann, ok := manifest["annotations"].(map[string]any)
-				if !ok {
-					ann = make(map[string]any)
-				}
-				if _, hasVersion := ann["org.opencontainers.image.version"]; !hasVersion && ref != "" {
-					ann["org.opencontainers.image.version"] = ref
-				}
-				manifest["annotations"] = ann
-				if newData, err := json.MarshalIndent(manifest, "", "  "); err == nil {
-					data = newData
-				}
+			if ctx.Err() != nil {
+				return "", err
 			}
-			_ = os.WriteFile(manifestPath, data, 0644)
+			errs = append(errs, fmt.Errorf("%s: %w", source.Name(), err))
+			continue
 		}
+		return desc.Digest.String(), nil
 	}
+	return "", fmt.Errorf("failed to resolve %s: %w", imageRef, errors.Join(errs...))
+}
 
-	return nil
+// resolveTag returns the manifest digest of the tag of an image in the registry itself (not its mirrors)
+func resolveTag(ctx context.Context, cfg *config.Config, imageRef artifact.Reference) (string, error) {
+	repo, err := registryauth.NewRepository(cfg, imageRef)
+	if err != nil {
+		return "", err
+	}
+	desc, err := repo.Resolve(ctx, imageRef.Tag)
+	if err != nil {
+		return "", err
+	}
+	return desc.Digest.String(), nil
+}
+
+// mirrorReference returns the reference of the image in a mirror, where the mirror
+// is in the form host[:port][/path-prefix]
+func mirrorReference(mirror string, ref artifact.Reference) artifact.Reference {
+	host, prefix, _ := strings.Cut(strings.TrimSuffix(mirror, "/"), "/")
+	mirrorRef := ref
+	mirrorRef.Registry = host
+	if prefix != "" {
+		mirrorRef.Repository = prefix + "/" + ref.Repository
+	}
+	return mirrorRef
+}
+
+// writeTarball saves the contents of dir (including manifest.json) as a tarball (with optional compression)
+func writeTarball(ctx context.Context, dir string, tarballPath string, compress bool) error {
+	out, err := os.Create(tarballPath)
+	if err != nil {
+		return fmt.Errorf("failed to create tarball: %w", err)
+	}
+	defer out.Close()
+	var gz *gzip.Writer
+	var tw *tar.Writer
+	if compress {
+		gz = gzip.NewWriter(out)
+		tw = tar.NewWriter(gz)
+	} else {
+		tw = tar.NewWriter(out)
+	}
+	// Walk dir and add files to tarball
+	addToTar := func(path string, info os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if info.IsDir() || info.Name() == imagestore.CompleteFile {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		stat, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		hdr := &tar.Header{
+			Name: strings.TrimPrefix(path, dir+string(os.PathSeparator)),
+			Size: stat.Size(),
+			Mode: int64(stat.Mode()),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, f); err != nil {
+			return err
+		}
+		return nil
+	}
+	if err := filepath.WalkDir(dir, addToTar); err != nil {
+		return fmt.Errorf("failed to create tarball: %w", err)
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to create tarball: %w", err)
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return fmt.Errorf("failed to create tarball: %w", err)
+		}
+	}
+	return out.Close()
 }
@@ -0,0 +1,160 @@
+package imagepull
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/thin-edge/tedge-oscar/internal/artifact"
+	"github.com/thin-edge/tedge-oscar/internal/config"
+)
+
+// fakeRegistry serves the manifests (by tag and digest) and blobs of a single repository
+type fakeRegistry struct {
+	manifests map[string][]byte
+	blobs     map[string][]byte
+}
+
+// push adds an image with a single main.js file, returning its manifest digest
+func (r *fakeRegistry) push(t *testing.T, tag string, script string) string {
+	t.Helper()
+	add := func(b []byte) digest.Digest {
+		dgst := digest.FromBytes(b)
+		r.blobs[dgst.String()] = b
+		return dgst
+	}
+	config := []byte("{}")
+	layer := []byte(script)
+	manifest := ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    ocispec.Descriptor{MediaType: ocispec.MediaTypeEmptyJSON, Digest: add(config), Size: int64(len(config))},
+		Layers: []ocispec.Descriptor{{
+			MediaType:   "application/javascript",
+			Digest:      add(layer),
+			Size:        int64(len(layer)),
+			Annotations: map[string]string{ocispec.AnnotationTitle: "main.js"},
+		}},
+	}
+	manifest.SchemaVersion = 2
+	b, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dgst := digest.FromBytes(b).String()
+	r.manifests[tag] = b
+	r.manifests[dgst] = b
+	return dgst
+}
+
+func (r *fakeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var body []byte
+	var ok bool
+	contentType := "application/octet-stream"
+	switch {
+	case req.URL.Path == "/v2/":
+		w.WriteHeader(http.StatusOK)
+		return
+	case strings.Contains(req.URL.Path, "/manifests/"):
+		body, ok = r.manifests[req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:]]
+		contentType = ocispec.MediaTypeImageManifest
+	case strings.Contains(req.URL.Path, "/blobs/"):
+		body, ok = r.blobs[req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:]]
+	}
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Header().Set("Docker-Content-Digest", digest.FromBytes(body).String())
+	if req.Method != http.MethodHead {
+		_, _ = w.Write(body)
+	}
+}
+
+func TestPullImageFromMirror(t *testing.T) {
+	tests := []struct {
+		name string
+		// upstream and mirror are the scripts of the image tagged 1.0 in each registry (empty if missing)
+		upstream string
+		mirror   string
+		// down stops the registry before pulling, e.g. the uplink is down
+		down         bool
+		trustMirrors bool
+		wantMirror   bool
+		wantErr      bool
+	}{
+		{name: "mirror serves the same image", upstream: "upstream", mirror: "upstream", wantMirror: true},
+		{name: "mirror serves a different image for the same tag", upstream: "upstream", mirror: "tampered"},
+		{name: "tag can not be resolved using the registry", mirror: "tampered", wantErr: true},
+		{name: "registry is down", upstream: "upstream", mirror: "upstream", down: true, wantErr: true},
+		{name: "registry is down and the mirrors are trusted", upstream: "upstream", mirror: "upstream", down: true, trustMirrors: true, wantMirror: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := &fakeRegistry{manifests: map[string][]byte{}, blobs: map[string][]byte{}}
+			mirror := &fakeRegistry{manifests: map[string][]byte{}, blobs: map[string][]byte{}}
+			var expectedDigest string
+			if tt.upstream != "" {
+				expectedDigest = upstream.push(t, "1.0", tt.upstream)
+			}
+			if tt.mirror != "" {
+				mirror.push(t, "1.0", tt.mirror)
+			}
+			upstreamServer := httptest.NewServer(upstream)
+			defer upstreamServer.Close()
+			mirrorServer := httptest.NewServer(mirror)
+			defer mirrorServer.Close()
+			upstreamHost := strings.TrimPrefix(upstreamServer.URL, "http://")
+			mirrorHost := strings.TrimPrefix(mirrorServer.URL, "http://")
+			if tt.down {
+				upstreamServer.Close()
+			}
+
+			cfg := &config.Config{
+				ImageDir: t.TempDir(),
+				Registries: []config.RegistryCredential{
+					{Registry: upstreamHost, PlainHTTP: true, Mirrors: []string{mirrorHost}, TrustMirrors: tt.trustMirrors},
+					{Registry: mirrorHost, PlainHTTP: true},
+				},
+			}
+			ref, err := artifact.ParseReference(upstreamHost + "/flows/counter:1.0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			outputDir := filepath.Join(cfg.ImageDir, "out")
+			result, err := PullImage(context.Background(), cfg, ref, outputDir, "", false)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, the image was pulled from %s", result.Source.Name())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Digest != expectedDigest {
+				t.Errorf("got digest %s, want %s", result.Digest, expectedDigest)
+			}
+			if gotMirror := result.Source.Registry == mirrorHost; gotMirror != tt.wantMirror {
+				t.Errorf("unexpected source %s", result.Source.Name())
+			}
+			script, err := os.ReadFile(filepath.Join(outputDir, "main.js"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(script) != tt.upstream {
+				t.Errorf("got script %q, want %q", script, tt.upstream)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package imagepull
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content/oci"
+	"oras.land/oras-go/v2/errdef"
+	"oras.land/oras-go/v2/registry/remote"
+
+	"github.com/thin-edge/tedge-oscar/internal/config"
+	"github.com/thin-edge/tedge-oscar/internal/imagestore"
+	"github.com/thin-edge/tedge-oscar/internal/registryauth"
+)
+
+const mediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+
+// fetchBlobs downloads the blobs of an image which are not cached yet. Each blob is written to a
+// partial file first, so that an interrupted download is resumed (using a range request) rather
+// than restarted. The blobs are verified against their digest when they are added to the cache.
+func fetchBlobs(ctx context.Context, retry config.RetryConfig, repo *remote.Repository, reference string, store *imagestore.Store, cache *oci.Store) error {
+	desc, manifestBytes, err := oras.FetchBytes(ctx, repo, reference, oras.DefaultFetchBytesOptions)
+	if err != nil {
+		return err
+	}
+	if desc.MediaType != ocispec.MediaTypeImageManifest && desc.MediaType != mediaTypeDockerManifest {
+		// Other artifacts (e.g. an index) are left to oras.Copy
+		return nil
+	}
+	// Docker manifests share the config and layers fields of OCI manifests
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	for _, blob := range append([]ocispec.Descriptor{manifest.Config}, manifest.Layers...) {
+		if exists, err := cache.Exists(ctx, blob); err == nil && exists {
+			continue
+		}
+		if err := fetchBlob(ctx, retry, repo, blob, store.PartialPath(blob.Digest), cache); err != nil {
+			return fmt.Errorf("failed to download blob %s: %w", blob.Digest, err)
+		}
+	}
+	return nil
+}
+
+func fetchBlob(ctx context.Context, retry config.RetryConfig, repo *remote.Repository, desc ocispec.Descriptor, partialPath string, cache *oci.Store) error {
+	if err := os.MkdirAll(filepath.Dir(partialPath), 0755); err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		err := downloadPartial(ctx, repo, desc, partialPath)
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil || attempt >= retry.Attempts || errors.Is(err, errdef.ErrNotFound) {
+			return err
+		}
+		wait := registryauth.Backoff(retry, attempt)
+		slog.Warn("Blob download interrupted, resuming", "digest", desc.Digest, "error", err, "attempt", attempt+1, "wait", wait)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+
+	f, err := os.Open(partialPath)
+	if err != nil {
+		return err
+	}
+	err = cache.Push(ctx, desc, f)
+	f.Close()
+	if err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
+		// The content does not match the digest, so start from scratch next time
+		_ = os.Remove(partialPath)
+		return err
+	}
+	return os.Remove(partialPath)
+}
+
+// downloadPartial appends the missing content of a blob to the partial file
+func downloadPartial(ctx context.Context, repo *remote.Repository, desc ocispec.Descriptor, partialPath string) error {
+	f, err := os.OpenFile(partialPath, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if offset > desc.Size {
+		if offset, err = restart(f); err != nil {
+			return err
+		}
+	}
+	if offset == desc.Size {
+		return nil
+	}
+
+	rc, err := repo.Blobs().Fetch(ctx, desc)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if offset > 0 {
+		// The reader is only seekable if the registry supports range requests
+		if seeker, ok := rc.(io.Seeker); ok {
+			slog.Info("Resuming blob download", "digest", desc.Digest, "offset", offset, "size", desc.Size)
+			if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+				return err
+			}
+		} else if _, err := restart(f); err != nil {
+			return err
+		}
+	}
+	if _, err := io.Copy(f, rc); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func restart(f *os.File) (int64, error) {
+	if err := f.Truncate(0); err != nil {
+		return 0, err
+	}
+	return f.Seek(0, io.SeekStart)
+}
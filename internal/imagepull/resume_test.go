@@ -0,0 +1,133 @@
+package imagepull
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/content/oci"
+	"oras.land/oras-go/v2/registry/remote"
+
+	"github.com/thin-edge/tedge-oscar/internal/config"
+)
+
+// blobServer serves a single blob, optionally supporting range requests and dropping the connection
+// of the first download half way
+type blobServer struct {
+	blob      []byte
+	ranges    bool
+	interrupt bool
+
+	mu       sync.Mutex
+	requests []string
+}
+
+func (s *blobServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, req.Header.Get("Range"))
+	first := len(s.requests) == 1
+	s.mu.Unlock()
+	if !strings.Contains(req.URL.Path, "/blobs/") {
+		http.NotFound(w, req)
+		return
+	}
+	if s.interrupt && first {
+		w.Header().Set("Content-Length", strconv.Itoa(len(s.blob)))
+		_, _ = w.Write(s.blob[:len(s.blob)/2])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+	if s.ranges {
+		http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(s.blob))
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(s.blob)))
+	_, _ = w.Write(s.blob)
+}
+
+func TestFetchBlobResume(t *testing.T) {
+	blob := bytes.Repeat([]byte("0123456789"), 1000)
+	tests := []struct {
+		name string
+		// partial is the content already downloaded
+		partial   []byte
+		ranges    bool
+		interrupt bool
+		// expectRange is the range requested by the last request (empty if the whole blob was downloaded)
+		expectRange string
+	}{
+		{name: "resume partial download", partial: blob[:4000], ranges: true, expectRange: "bytes=4000-9999"},
+		{name: "restart if ranges are not supported", partial: blob[:4000]},
+		{name: "restart if the partial download is too large", partial: append(append([]byte{}, blob...), "extra"...), ranges: true},
+		{name: "resume interrupted download", ranges: true, interrupt: true, expectRange: "bytes=5000-9999"},
+		{name: "partial download is complete", partial: blob, ranges: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &blobServer{blob: blob, ranges: tt.ranges, interrupt: tt.interrupt}
+			httpServer := httptest.NewServer(server)
+			defer httpServer.Close()
+			repo, err := remote.NewRepository(strings.TrimPrefix(httpServer.URL, "http://") + "/flows/counter")
+			if err != nil {
+				t.Fatal(err)
+			}
+			repo.PlainHTTP = true
+
+			dir := t.TempDir()
+			cache, err := oci.New(filepath.Join(dir, "cache"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			partialPath := filepath.Join(dir, "partial", "blob")
+			if tt.partial != nil {
+				if err := os.MkdirAll(filepath.Dir(partialPath), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(partialPath, tt.partial, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			desc := ocispec.Descriptor{MediaType: "application/javascript", Digest: digest.FromBytes(blob), Size: int64(len(blob))}
+			retry := config.RetryConfig{Attempts: 2, MinWait: time.Millisecond, MaxWait: time.Millisecond}
+			if err := fetchBlob(context.Background(), retry, repo, desc, partialPath, cache); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := content.FetchAll(context.Background(), cache, desc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, blob) {
+				t.Fatal("cached blob does not match")
+			}
+			if _, err := os.Stat(partialPath); !os.IsNotExist(err) {
+				t.Errorf("partial download was not removed")
+			}
+			server.mu.Lock()
+			defer server.mu.Unlock()
+			if tt.partial != nil && len(tt.partial) == len(blob) {
+				if len(server.requests) != 0 {
+					t.Errorf("complete partial download was downloaded again. requests=%q", server.requests)
+				}
+				return
+			}
+			if len(server.requests) == 0 {
+				t.Fatal("blob was not downloaded")
+			}
+			if got := server.requests[len(server.requests)-1]; got != tt.expectRange {
+				t.Errorf("unexpected range of the last request. got=%q, expected=%q", got, tt.expectRange)
+			}
+		})
+	}
+}
@@ -12,24 +12,18 @@ import (
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"oras.land/oras-go/v2"
 	"oras.land/oras-go/v2/content/memory"
-	"oras.land/oras-go/v2/registry/remote"
 
+	"github.com/thin-edge/tedge-oscar/internal/artifact"
 	"github.com/thin-edge/tedge-oscar/internal/config"
 	"github.com/thin-edge/tedge-oscar/internal/registryauth"
 )
 
 // PushImage pushes files as an OCI artifact, preserving their paths relative to rootDir.
-func PushImage(cfg *config.Config, imageRef string, ociType string, files []string, rootDir string) error {
+func PushImage(ctx context.Context, cfg *config.Config, imageRef artifact.Reference, ociType string, files []string, rootDir string) error {
 	var err error
-	repoRef, ref := imageRef, ""
-	if i := strings.LastIndex(imageRef, ":"); i > strings.LastIndex(imageRef, "/") {
-		repoRef = imageRef[:i]
-		ref = imageRef[i+1:]
-	} else if i := strings.LastIndex(imageRef, "@"); i > strings.LastIndex(imageRef, "/") {
-		repoRef = imageRef[:i]
-		ref = imageRef[i+1:]
-	}
-	if repoRef == imageRef || ref == "" {
+	// Push by tag, falling back to the digest if no tag was given
+	ref := imageRef.Version()
+	if ref == "" {
 		return fmt.Errorf("image reference must include a tag or digest, e.g. ghcr.io/user/repo:tag or @sha256:<hash>")
 	}
 	memStore := memory.New()
@@ -63,7 +57,7 @@ func PushImage(cfg *config.Config, imageRef string, ociType string, files []stri
 			Size:        int64(len(data)),
 			Annotations: map[string]string{"org.opencontainers.image.title": relPath},
 		}
-		if err := memStore.Push(context.Background(), d, contentReader); err != nil {
+		if err := memStore.Push(ctx, d, contentReader); err != nil {
 			return fmt.Errorf("failed to add file %s to store: %w", f, err)
 		}
 		descriptors = append(descriptors, d)
@@ -75,12 +69,12 @@ func PushImage(cfg *config.Config, imageRef string, ociType string, files []stri
 		Digest:    digest.FromBytes(configBytes),
 		Size:      int64(len(configBytes)),
 	}
-	if err := memStore.Push(context.Background(), configDesc, bytes.NewReader(configBytes)); err != nil {
+	if err := memStore.Push(ctx, configDesc, bytes.NewReader(configBytes)); err != nil {
 		return fmt.Errorf("failed to add config to store: %w", err)
 	}
 	var packVersion oras.PackManifestVersion
 	artifactType := ociType
-	if strings.HasPrefix(repoRef, "ghcr.io/") {
+	if imageRef.Registry == "ghcr.io" {
 		packVersion = oras.PackManifestVersion1_0
 		artifactType = ""
 	} else {
@@ -90,39 +84,25 @@ func PushImage(cfg *config.Config, imageRef string, ociType string, files []stri
 		ConfigDescriptor: &configDesc,
 		Layers:           descriptors,
 	}
-	manifestDesc, err := oras.PackManifest(context.Background(), memStore, packVersion, artifactType, packOpts)
+	manifestDesc, err := oras.PackManifest(ctx, memStore, packVersion, artifactType, packOpts)
 	if err != nil {
 		return fmt.Errorf("failed to pack manifest: %w", err)
 	}
 	// Tag the manifest in the memory store with the user-supplied tag and its own digest
-	if err := memStore.Tag(context.Background(), manifestDesc, ref); err != nil {
+	if err := memStore.Tag(ctx, manifestDesc, ref); err != nil {
 		return fmt.Errorf("failed to tag manifest in memory store: %w", err)
 	}
-	if err := memStore.Tag(context.Background(), manifestDesc, manifestDesc.Digest.String()); err != nil {
+	if err := memStore.Tag(ctx, manifestDesc, manifestDesc.Digest.String()); err != nil {
 		return fmt.Errorf("failed to tag manifest digest in memory store: %w", err)
 	}
 	// Prepare remote repository and authentication
-	var repo *remote.Repository
-	repo, err = remote.NewRepository(repoRef)
+	repo, err := registryauth.NewRepository(cfg, imageRef)
 	if err != nil {
-		return fmt.Errorf("invalid repository: %w", err)
-	}
-	// Use shared registry auth logic
-	scope := ""
-	if strings.HasPrefix(repoRef, "ghcr.io/") {
-		ownerRepo := strings.TrimPrefix(repoRef, "ghcr.io/")
-		scope = "repository:" + ownerRepo + ":push,pull"
-	}
-	client, _, _, _, err := registryauth.GetAuthenticatedClient(cfg, repoRef, scope)
-	if err != nil {
-		return fmt.Errorf("auth error: %w", err)
-	}
-	if client != nil {
-		repo.Client = client
+		return err
 	}
 	// Push the manifest and its blobs to the remote repository using the manifest digest as the source reference
 	copyOpts := oras.DefaultCopyOptions
-	_, err = oras.Copy(context.Background(), memStore, manifestDesc.Digest.String(), repo, ref, copyOpts)
+	_, err = oras.Copy(ctx, memStore, manifestDesc.Digest.String(), repo, ref, copyOpts)
 	if err != nil {
 		return fmt.Errorf("oras push failed: %w", err)
 	}
@@ -0,0 +1,206 @@
+package imagestore
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/content/oci"
+
+	"github.com/thin-edge/tedge-oscar/internal/artifact"
+	"github.com/thin-edge/tedge-oscar/internal/util"
+)
+
+// CacheDir is the folder inside the image_dir holding the OCI image layout (oci-layout, index.json, blobs/sha256)
+// of all pulled images. Blobs are content-addressable so they are shared between image versions.
+const CacheDir = ".oci"
+
+// partialDir is the folder inside the cache holding partially downloaded blobs
+const partialDir = "partial"
+
+const (
+	// AnnotationDigest records the digest of the original manifest in the stored manifest.json
+	AnnotationDigest = "io.thin-edge.oscar.manifest.digest"
+	// AnnotationReference records the image reference in the stored manifest.json
+	AnnotationReference = "io.thin-edge.oscar.reference"
+	// AnnotationSource records the repository the image was pulled from (the registry or one of its mirrors)
+	AnnotationSource = "io.thin-edge.oscar.source"
+
+	// annotationUnpack marks a layer as a (gzipped) tarball of a directory, as created by oras
+	annotationUnpack = "io.deis.oras.content.unpack"
+)
+
+// Cache opens the OCI image layout store of the image_dir
+func (s *Store) Cache(ctx context.Context) (*oci.Store, error) {
+	cache, err := oci.NewWithContext(ctx, filepath.Join(s.Root, CacheDir))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open image cache: %w", err)
+	}
+	return cache, nil
+}
+
+// CacheTag returns the reference used to tag an image in the cache
+func CacheTag(ref artifact.Reference) string {
+	if ref.Digest != "" {
+		return ref.Name() + "@" + ref.Digest
+	}
+	return ref.Name() + ":" + ref.Tag
+}
+
+// PartialPath returns the file used to download a blob, which is kept if the download is interrupted
+func (s *Store) PartialPath(dgst digest.Digest) string {
+	return filepath.Join(s.Root, CacheDir, partialDir, dgst.Algorithm().String()+"-"+dgst.Encoded())
+}
+
+// GC untags cached images whose image folder no longer exists, and removes all blobs which are
+// no longer referenced along with any partially downloaded blobs and abandoned staging folders
+func (s *Store) GC(ctx context.Context) error {
+	if err := s.removeStaging(); err != nil {
+		return fmt.Errorf("failed to remove staging folders: %w", err)
+	}
+	if _, err := os.Stat(filepath.Join(s.Root, CacheDir)); os.IsNotExist(err) {
+		return nil
+	}
+	if err := os.RemoveAll(filepath.Join(s.Root, CacheDir, partialDir)); err != nil {
+		return fmt.Errorf("failed to remove partial downloads: %w", err)
+	}
+	cache, err := s.Cache(ctx)
+	if err != nil {
+		return err
+	}
+	var tags []string
+	if err := cache.Tags(ctx, "", func(page []string) error {
+		tags = append(tags, page...)
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to list cached images: %w", err)
+	}
+	for _, tag := range tags {
+		ref, err := artifact.ParseReference(tag)
+		if err != nil {
+			continue
+		}
+		if isImageDir(s.Path(ref)) {
+			continue
+		}
+		slog.Info("Removing unused image from cache", "reference", tag)
+		if err := cache.Untag(ctx, tag); err != nil {
+			return fmt.Errorf("failed to untag %s: %w", tag, err)
+		}
+	}
+	if err := cache.GC(ctx); err != nil {
+		return fmt.Errorf("failed to remove unreferenced blobs: %w", err)
+	}
+	return nil
+}
+
+// Materialise writes the files of a cached image into dir, along with its manifest (manifest.json)
+// which is annotated with the version, reference and manifest digest of the image, and any additional annotations.
+func Materialise(ctx context.Context, cache content.ReadOnlyStorage, desc ocispec.Descriptor, dir string, ref artifact.Reference, annotations map[string]string) error {
+	manifestBytes, err := content.FetchAll(ctx, cache, desc)
+	if err != nil {
+		return fmt.Errorf("failed to read manifest: %w", err)
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, layer := range manifest.Layers {
+		title := layer.Annotations[ocispec.AnnotationTitle]
+		if title == "" {
+			slog.Warn("Skipping layer without a title", "digest", layer.Digest)
+			continue
+		}
+		if filepath.IsAbs(title) || strings.Contains(title, "..") {
+			slog.Warn("Skipping layer as its title is not a relative path. This is not allowed to prevent path traversal attacks.", "title", title)
+			continue
+		}
+		if err := writeLayer(ctx, cache, layer, filepath.Join(dir, filepath.FromSlash(title))); err != nil {
+			return fmt.Errorf("failed to write %s: %w", title, err)
+		}
+	}
+
+	// Save the manifest JSON to the image folder, preserving any unknown fields
+	var data map[string]any
+	if err := json.Unmarshal(manifestBytes, &data); err != nil {
+		return fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	ann, ok := data["annotations"].(map[string]any)
+	if !ok {
+		ann = make(map[string]any)
+	}
+	if _, hasVersion := ann[ocispec.AnnotationVersion]; !hasVersion && ref.Version() != "" {
+		ann[ocispec.AnnotationVersion] = ref.Version()
+	}
+	ann[AnnotationReference] = ref.String()
+	ann[AnnotationDigest] = desc.Digest.String()
+	for k, v := range annotations {
+		ann[k] = v
+	}
+	data["annotations"] = ann
+	out, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, ManifestFile), out, 0644)
+}
+
+// writeLayer writes a cached layer to path, verifying its content against the digest of the layer
+func writeLayer(ctx context.Context, cache content.ReadOnlyStorage, layer ocispec.Descriptor, path string) error {
+	rc, err := cache.Fetch(ctx, layer)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	vr := content.NewVerifyReader(util.NewContextReader(ctx, rc), layer)
+
+	if layer.Annotations[annotationUnpack] == "true" {
+		var r io.Reader = vr
+		if strings.HasSuffix(layer.MediaType, "gzip") {
+			gz, err := gzip.NewReader(vr)
+			if err != nil {
+				return err
+			}
+			defer gz.Close()
+			r = gz
+		}
+		// Entries are prefixed with the directory name
+		if err := util.ExtractTar(r, filepath.Dir(path)); err != nil {
+			return err
+		}
+		// Read any trailing padding so that the whole layer is verified
+		if _, err := io.Copy(io.Discard, vr); err != nil {
+			return err
+		}
+		return vr.Verify()
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, vr); err != nil {
+		f.Close()
+		return err
+	}
+	if err := vr.Verify(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,358 @@
+package imagestore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+
+	"github.com/thin-edge/tedge-oscar/internal/artifact"
+)
+
+// ManifestFile is the name of the file storing the image manifest inside each image folder
+const ManifestFile = "manifest.json"
+
+// flowFiles are the names of the flow definition of an image, which is the only required file of a flow package
+var flowFiles = []string{"flow.toml", "pipeline.toml"}
+
+// Store manages the local image_dir which uses the layout <registry>/<repository>/<version>,
+// where the version is either the tag or the manifest digest.
+type Store struct {
+	Root string
+}
+
+// Image is an image stored in the image_dir
+type Image struct {
+	Dir       string
+	Reference artifact.Reference
+}
+
+// Name returns the image name without the version, e.g. ghcr.io/thin-edge/counter
+func (img Image) Name() string {
+	return img.Reference.Name()
+}
+
+// String returns the image name with the version, e.g. ghcr.io/thin-edge/counter:1.0
+func (img Image) String() string {
+	return img.Reference.String()
+}
+
+// New returns a store for the given image_dir
+func New(root string) *Store {
+	return &Store{Root: root}
+}
+
+// Path returns the folder used to store the given image reference.
+// Digest references are stored by digest so that they never collide with a (mutable) tag.
+// A version constraint must be resolved to a tag first, as it does not identify a single folder (see Lookup).
+func (s *Store) Path(ref artifact.Reference) string {
+	version := ref.Tag
+	if ref.Digest != "" {
+		version = ref.Digest
+	}
+	if version == "" {
+		version = "latest"
+	}
+	return filepath.Join(s.Root, escapeName(ref.Registry), filepath.FromSlash(ref.Repository), escapeName(version))
+}
+
+// escapeName replaces the ':' of a registry port or a digest (e.g. localhost:5000 or sha256:<hex>), as it is not
+// allowed in file names on Windows. The replacement is neither allowed in a registry host nor in a tag.
+func escapeName(name string) string {
+	return strings.ReplaceAll(name, ":", "+")
+}
+
+func unescapeName(name string) string {
+	return strings.ReplaceAll(name, "+", ":")
+}
+
+// Lookup returns the folder of a locally stored image and whether it exists.
+// Images referenced without a registry also match images loaded from a tarball.
+// A reference with a version constraint never matches, as the constraint must be resolved to a tag first.
+func (s *Store) Lookup(ref artifact.Reference) (string, bool) {
+	if ref.Constraint != "" {
+		return "", false
+	}
+	path := s.Path(ref)
+	if isImageDir(path) {
+		return path, true
+	}
+	if ref.Registry == artifact.DockerHubRegistry && strings.HasPrefix(ref.Repository, artifact.DockerHubLibrary+"/") {
+		local := ref
+		local.Registry = artifact.LocalRegistry
+		local.Repository = ref.Base()
+		if localPath := s.Path(local); isImageDir(localPath) {
+			return localPath, true
+		}
+	}
+	return path, false
+}
+
+// List returns all images stored in the image_dir
+func (s *Store) List() ([]Image, error) {
+	images := []Image{}
+	err := filepath.WalkDir(s.Root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == s.Root {
+				return filepath.SkipAll
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if path != s.Root && strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if !isImageDir(path) {
+			return nil
+		}
+		if img, err := s.ImageFromDir(path); err == nil {
+			images = append(images, img)
+		}
+		return filepath.SkipDir
+	})
+	return images, err
+}
+
+// ImageFromDir returns the image stored in the given folder
+func (s *Store) ImageFromDir(dir string) (Image, error) {
+	img := Image{Dir: dir}
+	rel, err := filepath.Rel(s.Root, dir)
+	if err != nil {
+		return img, err
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	if len(parts) == 1 && parts[0] != "." && parts[0] != ".." {
+		// Legacy image folders (e.g. <image_dir>/counter:1.0) which have not been migrated yet
+		img.Reference = legacyReference(parts[0])
+		return img, nil
+	}
+	if len(parts) < 3 || parts[0] == ".." {
+		return img, fmt.Errorf("folder is not an image folder of the image_dir. path=%s", dir)
+	}
+	img.Reference.Registry = unescapeName(parts[0])
+	img.Reference.Repository = strings.Join(parts[1:len(parts)-1], "/")
+	version := unescapeName(parts[len(parts)-1])
+	if _, err := digest.Parse(version); err == nil {
+		img.Reference.Digest = version
+	} else {
+		img.Reference.Tag = version
+	}
+	return img, nil
+}
+
+// FindImage returns the image containing the given path, e.g. the script of a deployed instance
+func (s *Store) FindImage(path string) (Image, error) {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	root := s.Root
+	if resolved, err := filepath.EvalSymlinks(root); err == nil {
+		root = resolved
+	}
+	for dir := filepath.Dir(path); strings.HasPrefix(dir, root) && dir != root; dir = filepath.Dir(dir) {
+		if isImageDir(dir) {
+			return (&Store{Root: root}).ImageFromDir(dir)
+		}
+	}
+	return Image{}, fmt.Errorf("path is not part of an image. path=%s", path)
+}
+
+// Remove deletes an image folder and any empty parent folders
+func (s *Store) Remove(img Image) error {
+	if err := os.RemoveAll(img.Dir); err != nil {
+		return err
+	}
+	for dir := filepath.Dir(img.Dir); dir != s.Root && strings.HasPrefix(dir, s.Root); dir = filepath.Dir(dir) {
+		if err := os.Remove(dir); err != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// Migrate moves images stored using the legacy <name>:<tag> layout into the
+// local registry namespace. A symlink is left at the old location so that
+// already deployed instances continue to work. Images written before completion
+// markers were introduced are marked as complete if their files match the manifest.
+func (s *Store) Migrate() error {
+	if err := s.migrateLayout(); err != nil {
+		return err
+	}
+	if err := s.migrateNames(); err != nil {
+		return err
+	}
+	images, err := s.List()
+	if err != nil {
+		return err
+	}
+	for _, img := range images {
+		if IsComplete(img.Dir) {
+			continue
+		}
+		if err := Verify(img.Dir); err != nil {
+			slog.Warn("Image folder is incomplete", "path", img.Dir, "error", err)
+			continue
+		}
+		if err := MarkComplete(img.Dir, ReadAnnotation(img.Dir, AnnotationDigest)); err != nil {
+			return fmt.Errorf("failed to mark image folder as complete: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *Store) migrateLayout() error {
+	entries, err := os.ReadDir(s.Root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		oldPath := filepath.Join(s.Root, entry.Name())
+		if entry.Type()&fs.ModeSymlink != 0 {
+			// Remove legacy links whose image has since been removed
+			if _, err := os.Stat(oldPath); os.IsNotExist(err) {
+				_ = os.Remove(oldPath)
+			}
+			continue
+		}
+		if !entry.IsDir() || !isImageDir(oldPath) {
+			continue
+		}
+		ref := legacyReference(entry.Name())
+		newPath := s.Path(ref)
+		if _, err := os.Stat(newPath); err == nil {
+			slog.Warn("Skipping migration of legacy image folder as the destination already exists", "path", oldPath, "destination", newPath)
+			continue
+		}
+		slog.Info("Migrating legacy image folder", "path", oldPath, "destination", newPath)
+		if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
+			return fmt.Errorf("failed to migrate image folder %s: %w", oldPath, err)
+		}
+		if err := os.Rename(oldPath, newPath); err != nil {
+			return fmt.Errorf("failed to migrate image folder %s: %w", oldPath, err)
+		}
+		target, err := filepath.Rel(s.Root, newPath)
+		if err != nil {
+			target = newPath
+		}
+		if err := os.Symlink(target, oldPath); err != nil {
+			slog.Warn("Could not create link to migrated image folder", "path", oldPath, "error", err)
+		}
+	}
+	return nil
+}
+
+// legacyReference returns the reference of a legacy image folder (e.g. counter:1.0 or counter@sha256:<hex>),
+// which is stored under the local registry namespace
+func legacyReference(name string) artifact.Reference {
+	ref := artifact.Reference{
+		Registry:   artifact.LocalRegistry,
+		Repository: artifact.TrimVersion(name),
+	}
+	if i := strings.Index(name, "@"); i != -1 {
+		ref.Digest = name[i+1:]
+	} else if i := strings.Index(name, ":"); i != -1 {
+		ref.Tag = name[i+1:]
+	}
+	return ref
+}
+
+// migrateNames escapes the folders of registries and digests which were created with a ':' in their name
+// (see escapeName). A symlink is left at the old location so that already deployed instances continue to work.
+func (s *Store) migrateNames() error {
+	var folders []string
+	err := filepath.WalkDir(s.Root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == s.Root {
+				return filepath.SkipAll
+			}
+			return err
+		}
+		if !d.IsDir() || path == s.Root {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		// Legacy image folders which were not migrated (see migrateLayout) are left as is
+		if filepath.Dir(path) == s.Root && isImageDir(path) {
+			return filepath.SkipDir
+		}
+		if strings.Contains(d.Name(), ":") {
+			folders = append(folders, path)
+		}
+		if isImageDir(path) {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// The nested folders are renamed before the folders containing them
+	for i := len(folders) - 1; i >= 0; i-- {
+		oldPath := folders[i]
+		name := escapeName(filepath.Base(oldPath))
+		newPath := filepath.Join(filepath.Dir(oldPath), name)
+		if _, err := os.Lstat(newPath); err == nil {
+			slog.Warn("Skipping migration of image folder as the destination already exists", "path", oldPath, "destination", newPath)
+			continue
+		}
+		slog.Info("Migrating image folder", "path", oldPath, "destination", newPath)
+		if err := os.Rename(oldPath, newPath); err != nil {
+			return fmt.Errorf("failed to migrate image folder %s: %w", oldPath, err)
+		}
+		if err := os.Symlink(name, oldPath); err != nil {
+			slog.Warn("Could not create link to migrated image folder", "path", oldPath, "error", err)
+		}
+	}
+	return nil
+}
+
+// ReadManifest reads the stored manifest of an image folder
+func ReadManifest(dir string) (map[string]any, error) {
+	f, err := os.Open(filepath.Join(dir, ManifestFile))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var manifest map[string]any
+	if err := json.NewDecoder(f).Decode(&manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// ReadAnnotation reads an annotation from the stored manifest of an image folder
+func ReadAnnotation(dir string, key string) string {
+	manifest, err := ReadManifest(dir)
+	if err != nil {
+		return ""
+	}
+	if ann, ok := manifest["annotations"].(map[string]any); ok {
+		if v, ok := ann[key].(string); ok {
+			return v
+		}
+	}
+	return ""
+}
+
+// isImageDir returns true if dir holds an image: either it was marked as complete, or it has a manifest (pulled images)
+// or a flow definition (images loaded from a tarball in the flow format, and legacy image folders)
+func isImageDir(dir string) bool {
+	for _, name := range append([]string{CompleteFile, ManifestFile}, flowFiles...) {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return true
+		}
+	}
+	return false
+}
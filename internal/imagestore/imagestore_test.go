@@ -0,0 +1,91 @@
+package imagestore
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/thin-edge/tedge-oscar/internal/artifact"
+)
+
+func TestPathHasNoColon(t *testing.T) {
+	store := New(t.TempDir())
+	for _, s := range []string{
+		"localhost:5000/flows/counter:1.0",
+		"ghcr.io/thin-edge/counter@sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+	} {
+		ref, err := artifact.ParseReference(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := store.Path(ref)
+		if rel, _ := filepath.Rel(store.Root, path); strings.Contains(rel, ":") {
+			t.Errorf("image folder contains a ':'. path=%s", rel)
+		}
+		img, err := store.ImageFromDir(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if img.String() != ref.String() {
+			t.Errorf("got reference %s, want %s", img, ref)
+		}
+	}
+}
+
+func TestMigrateNames(t *testing.T) {
+	store := New(t.TempDir())
+	oldDir := filepath.Join(store.Root, "localhost:5000", "flows", "counter", "sha256:abcd")
+	if err := os.MkdirAll(oldDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(oldDir, CompleteFile), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if !IsComplete(filepath.Join(store.Root, "localhost+5000", "flows", "counter", "sha256+abcd")) {
+		t.Fatal("image folder was not migrated")
+	}
+	// The old location is kept as a link
+	if !IsComplete(oldDir) {
+		t.Fatal("image folder can not be found at its old location")
+	}
+}
+
+func TestLookupConstraint(t *testing.T) {
+	store := New(t.TempDir())
+	latest := filepath.Join(store.Root, "local", "counter", "latest")
+	if err := os.MkdirAll(latest, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(latest, CompleteFile), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ref, err := artifact.ParseReference("local/counter:^1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path, found := store.Lookup(ref); found {
+		t.Fatalf("a version constraint must not match an image folder. path=%s", path)
+	}
+}
+
+func TestListLegacyFolder(t *testing.T) {
+	store := New(t.TempDir())
+	legacy := filepath.Join(store.Root, "counter:1.0")
+	if err := os.MkdirAll(legacy, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(legacy, "flow.toml"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	images, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 1 || images[0].String() != "local/counter:1.0" {
+		t.Fatalf("legacy image folder is not listed as a local image. got=%v", images)
+	}
+}
@@ -0,0 +1,125 @@
+package imagestore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// Pin stores a copy of an image under its digest (e.g. <image_dir>/ghcr.io/thin-edge/counter/sha256+abcd...),
+// so that the files of an instance using it do not change when the (mutable) tag is pulled again.
+// It returns the pinned image, whose reference includes both the tag and the digest.
+func (s *Store) Pin(ctx context.Context, img Image) (Image, error) {
+	if img.Reference.Digest != "" {
+		return img, nil
+	}
+	dgst := ReadAnnotation(img.Dir, AnnotationDigest)
+	if dgst == "" {
+		return img, fmt.Errorf("the digest of image %s is unknown. path=%s", img, img.Dir)
+	}
+	if err := Verify(img.Dir); err != nil {
+		return img, fmt.Errorf("image %s is incomplete: %w", img, err)
+	}
+	pinned := Image{Reference: img.Reference}
+	pinned.Reference.Digest = dgst
+	pinned.Dir = s.Path(pinned.Reference)
+	if IsComplete(pinned.Dir) {
+		return pinned, nil
+	}
+
+	staging, err := Stage(pinned.Dir)
+	if err != nil {
+		return img, err
+	}
+	defer os.RemoveAll(staging)
+	if err := copyImageDir(ctx, img.Dir, staging); err != nil {
+		return img, fmt.Errorf("failed to copy image: %w", err)
+	}
+	manifest, err := ReadManifest(staging)
+	if err != nil {
+		return img, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	if ann, ok := manifest["annotations"].(map[string]any); ok {
+		ann[AnnotationReference] = pinned.Reference.String()
+	}
+	out, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return img, err
+	}
+	if err := os.WriteFile(filepath.Join(staging, ManifestFile), out, 0644); err != nil {
+		return img, err
+	}
+	if err := Commit(staging, pinned.Dir, dgst); err != nil {
+		return img, err
+	}
+	return pinned, nil
+}
+
+// copyImageDir copies the files of an image folder, except for its completion marker
+func copyImageDir(ctx context.Context, src string, dest string) error {
+	return copyDir(ctx, src, dest, []string{CompleteFile})
+}
+
+// ExportFiles copies the files of an image folder to dest, leaving out the files describing the image
+// in the image_dir (its manifest and completion marker) and the excluded files
+func ExportFiles(ctx context.Context, dir string, dest string, exclude ...string) error {
+	return copyDir(ctx, dir, dest, append([]string{ManifestFile, CompleteFile}, exclude...))
+}
+
+// copyDir copies a folder, except for the given files (relative to src)
+func copyDir(ctx context.Context, src string, dest string, exclude []string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+		switch {
+		case rel == ".":
+			return nil
+		case d.IsDir():
+			return os.MkdirAll(target, 0755)
+		case slices.Contains(exclude, rel):
+			return nil
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		}
+		return copyFile(path, target)
+	})
+}
+
+func copyFile(src string, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
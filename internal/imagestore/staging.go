@@ -0,0 +1,231 @@
+package imagestore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// CompleteFile marks an image folder as completely written. It contains the manifest digest of the image (if known).
+const CompleteFile = ".complete"
+
+// stagingPattern is the suffix of the hidden folders used to assemble an image next to its final location
+const stagingPattern = ".staging-*"
+
+// Stage creates a hidden folder next to dest in which an image is assembled before
+// being moved into place by Commit. Both folders are on the same file system, so the move is a rename.
+func Stage(dest string) (string, error) {
+	parent := filepath.Dir(dest)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return "", err
+	}
+	dir, err := os.MkdirTemp(parent, "."+filepath.Base(dest)+stagingPattern)
+	if err != nil {
+		return "", fmt.Errorf("failed to create staging folder: %w", err)
+	}
+	return dir, nil
+}
+
+// Commit verifies the image assembled in the staging folder, marks it as complete and moves it to dest,
+// replacing any existing image. It must only be used for the image folders of a store (see Store.IsImagePath).
+func Commit(staging string, dest string, digest string) error {
+	// The folder is marked first, so that the digest is verified against the stored manifest
+	if err := MarkComplete(staging, digest); err != nil {
+		return err
+	}
+	if err := Verify(staging); err != nil {
+		return err
+	}
+	old := ""
+	if _, err := os.Lstat(dest); err == nil {
+		old = staging + ".old"
+		if err := os.Rename(dest, old); err != nil {
+			return fmt.Errorf("failed to replace image folder: %w", err)
+		}
+	}
+	if err := os.Rename(staging, dest); err != nil {
+		if old != "" {
+			_ = os.Rename(old, dest)
+		}
+		return fmt.Errorf("failed to move image into place: %w", err)
+	}
+	if old != "" {
+		return os.RemoveAll(old)
+	}
+	return nil
+}
+
+// Merge verifies the image assembled in the staging folder and moves its files into dest, keeping the
+// other files of dest. It is used for folders outside of the image store (e.g. given by --output-dir),
+// which are never replaced as a whole.
+func Merge(staging string, dest string) error {
+	if err := Verify(staging); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+	return filepath.WalkDir(staging, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(staging, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+		if d.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		if err := os.Rename(path, target); err != nil {
+			return fmt.Errorf("failed to move image file into place: %w", err)
+		}
+		return nil
+	})
+}
+
+// IsImagePath returns true if dir is an image folder of the store (see Path), which is replaced as a whole
+// when the image is written again. Other folders, such as the image_dir itself or the folder of a registry, are not.
+func (s *Store) IsImagePath(dir string) bool {
+	root, err := filepath.Abs(s.Root)
+	if err != nil {
+		return false
+	}
+	if dir, err = filepath.Abs(dir); err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(root, dir)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return false
+	}
+	if _, err := os.Lstat(dir); os.IsNotExist(err) {
+		return true
+	}
+	return isImageDir(dir)
+}
+
+// MarkComplete marks an image folder as completely written
+func MarkComplete(dir string, digest string) error {
+	return os.WriteFile(filepath.Join(dir, CompleteFile), []byte(digest), 0644)
+}
+
+// IsComplete returns true if the image folder has been completely written
+func IsComplete(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, CompleteFile))
+	return err == nil
+}
+
+// Verify checks that all files listed in the manifest of an image folder exist with the expected content,
+// and that the manifest digest recorded in the stored manifest matches the one the folder was marked complete with.
+// Folders without a manifest can not be verified and are accepted as is.
+func Verify(dir string) error {
+	manifestBytes, err := os.ReadFile(filepath.Join(dir, ManifestFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return fmt.Errorf("invalid manifest: %w", err)
+	}
+	if err := verifyManifestDigest(dir, manifest.Annotations[AnnotationDigest]); err != nil {
+		return err
+	}
+	for _, layer := range manifest.Layers {
+		title := layer.Annotations[ocispec.AnnotationTitle]
+		if title == "" || filepath.IsAbs(title) || strings.Contains(title, "..") {
+			continue
+		}
+		path := filepath.Join(dir, filepath.FromSlash(title))
+		info, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("image is missing %s: %w", title, err)
+		}
+		if layer.Annotations[annotationUnpack] == "true" {
+			// The tarball of a directory is extracted, so only its presence can be checked
+			continue
+		}
+		if info.Size() != layer.Size {
+			return fmt.Errorf("image file %s has an unexpected size. got=%d, expected=%d", title, info.Size(), layer.Size)
+		}
+		if err := verifyFile(path, layer.Digest); err != nil {
+			return fmt.Errorf("image file %s is corrupt: %w", title, err)
+		}
+	}
+	return nil
+}
+
+// verifyManifestDigest checks the manifest digest annotation of a stored manifest against the digest
+// recorded when the folder was marked as complete
+func verifyManifestDigest(dir string, annotation string) error {
+	if annotation != "" {
+		if _, err := digest.Parse(annotation); err != nil {
+			return fmt.Errorf("invalid manifest digest %q: %w", annotation, err)
+		}
+	}
+	recorded, err := os.ReadFile(filepath.Join(dir, CompleteFile))
+	if err != nil || len(recorded) == 0 {
+		return nil
+	}
+	if string(recorded) != annotation {
+		return fmt.Errorf("stored manifest does not match the digest of the image. got=%s, expected=%s", annotation, recorded)
+	}
+	return nil
+}
+
+// verifyFile checks the content of a file against its digest
+func verifyFile(path string, dgst digest.Digest) error {
+	if err := dgst.Validate(); err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	verifier := dgst.Verifier()
+	if _, err := io.Copy(verifier, f); err != nil {
+		return err
+	}
+	if !verifier.Verified() {
+		return fmt.Errorf("content does not match digest %s", dgst)
+	}
+	return nil
+}
+
+// removeStaging removes the staging folders left behind by pulls which were killed
+func (s *Store) removeStaging() error {
+	return filepath.WalkDir(s.Root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == s.Root {
+				return filepath.SkipAll
+			}
+			return err
+		}
+		if !d.IsDir() || path == s.Root {
+			return nil
+		}
+		if d.Name() == CacheDir {
+			return filepath.SkipDir
+		}
+		if matched, _ := filepath.Match(".*"+stagingPattern, d.Name()); matched {
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+			return filepath.SkipDir
+		}
+		if isImageDir(path) {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
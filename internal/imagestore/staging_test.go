@@ -0,0 +1,69 @@
+package imagestore
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestVerify(t *testing.T) {
+	const script = "export function onMessage(message) { return [message] }"
+	const manifestDigest = "sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+	tests := []struct {
+		name string
+		// script is the content of the stored main.js (empty if missing)
+		script string
+		// complete is the digest the folder was marked complete with (empty if not marked)
+		complete string
+		wantErr  bool
+	}{
+		{name: "valid", script: script, complete: manifestDigest},
+		{name: "not marked complete", script: script},
+		{name: "missing file", wantErr: true},
+		{name: "corrupt file of the same size", script: "export function onMessage(message) { return [massage] }", wantErr: true},
+		{name: "manifest of another image", script: script, complete: "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			manifest := ocispec.Manifest{
+				MediaType: ocispec.MediaTypeImageManifest,
+				Layers: []ocispec.Descriptor{{
+					MediaType:   "application/javascript",
+					Digest:      digest.FromString(script),
+					Size:        int64(len(script)),
+					Annotations: map[string]string{ocispec.AnnotationTitle: "main.js"},
+				}},
+				Annotations: map[string]string{AnnotationDigest: manifestDigest},
+			}
+			b, err := json.Marshal(manifest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, ManifestFile), b, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if tt.script != "" {
+				if err := os.WriteFile(filepath.Join(dir, "main.js"), []byte(tt.script), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.complete != "" {
+				if err := MarkComplete(dir, tt.complete); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = Verify(dir)
+			if tt.wantErr && err == nil {
+				t.Fatal("expected an error")
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package imagetags
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/Masterminds/semver/v3"
+	"oras.land/oras-go/v2/registry"
+
+	"github.com/thin-edge/tedge-oscar/internal/artifact"
+)
+
+// List returns all tags of a repository. The registry returns the tags in pages
+// which are requested until the last page is reached.
+func List(ctx context.Context, repo registry.TagLister) ([]string, error) {
+	tags := []string{}
+	if err := repo.Tags(ctx, "", func(page []string) error {
+		tags = append(tags, page...)
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to list tags: %w", err)
+	}
+	return tags, nil
+}
+
+// Sort sorts tags by semantic version, newest first. Tags which are not a semantic
+// version (e.g. latest) are sorted alphabetically after the versioned tags.
+func Sort(tags []string) {
+	versions := make(map[string]*semver.Version, len(tags))
+	for _, tag := range tags {
+		if v, err := semver.NewVersion(tag); err == nil {
+			versions[tag] = v
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool {
+		vi, vj := versions[tags[i]], versions[tags[j]]
+		switch {
+		case vi != nil && vj != nil:
+			if !vi.Equal(vj) {
+				return vi.GreaterThan(vj)
+			}
+			// e.g. 1.0 and 1.0.0
+			return tags[i] < tags[j]
+		case vi != nil:
+			return true
+		case vj != nil:
+			return false
+		}
+		return tags[i] < tags[j]
+	})
+}
+
+// Filter returns the tags which are a semantic version matching the constraint, e.g. ">=1.2, <2" or "~1.4"
+func Filter(tags []string, constraint string) ([]string, error) {
+	c, err := semver.NewConstraint(constraint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid version constraint %q: %w", constraint, err)
+	}
+	matches := []string{}
+	for _, tag := range tags {
+		if v, err := semver.NewVersion(tag); err == nil && c.Check(v) {
+			matches = append(matches, tag)
+		}
+	}
+	return matches, nil
+}
+
+// Latest returns the highest version of the tags matching the constraint
+func Latest(tags []string, constraint string) (string, error) {
+	matches, err := Filter(tags, constraint)
+	if err != nil {
+		return "", err
+	}
+	if len(matches) == 0 {
+		return "", fmt.Errorf("no version matches %q", constraint)
+	}
+	Sort(matches)
+	return matches[0], nil
+}
+
+// Newer returns the highest semantic version of the tags which is newer than the current version, or an
+// empty string if there is none. Pre-releases are only considered if the current version is a pre-release.
+func Newer(tags []string, current string) string {
+	cv, err := semver.NewVersion(current)
+	if err != nil {
+		return ""
+	}
+	newer := []string{}
+	for _, tag := range tags {
+		v, err := semver.NewVersion(tag)
+		if err != nil || !v.GreaterThan(cv) || (v.Prerelease() != "" && cv.Prerelease() == "") {
+			continue
+		}
+		newer = append(newer, tag)
+	}
+	if len(newer) == 0 {
+		return ""
+	}
+	Sort(newer)
+	return newer[0]
+}
+
+// Resolve resolves the version constraint of an image reference to the highest matching tag of the
+// repository. References without a constraint are returned as is.
+func Resolve(ctx context.Context, repo registry.TagLister, ref artifact.Reference) (artifact.Reference, error) {
+	if ref.Constraint == "" {
+		return ref, nil
+	}
+	tags, err := List(ctx, repo)
+	if err != nil {
+		return ref, err
+	}
+	tag, err := Latest(tags, ref.Constraint)
+	if err != nil {
+		return ref, fmt.Errorf("failed to resolve %s: %w", ref, err)
+	}
+	ref.Tag = tag
+	ref.Constraint = ""
+	return ref, nil
+}
@@ -0,0 +1,80 @@
+package imagetags
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSort(t *testing.T) {
+	tags := []string{"latest", "1.2.0", "v1.10.0", "main", "1.9", "2.0.0-rc.1", "2.0.0", "1.2.0-beta"}
+	Sort(tags)
+	expect := []string{"2.0.0", "2.0.0-rc.1", "v1.10.0", "1.9", "1.2.0", "1.2.0-beta", "latest", "main"}
+	if !reflect.DeepEqual(tags, expect) {
+		t.Errorf("got %v, want %v", tags, expect)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	tags := []string{"latest", "1.2.0", "1.4.1", "1.4.7", "1.5.0", "2.0.0", "2.1.0-rc.1"}
+	tests := []struct {
+		constraint string
+		expect     []string
+		wantErr    bool
+	}{
+		{constraint: "~1.4", expect: []string{"1.4.1", "1.4.7"}},
+		{constraint: "^1", expect: []string{"1.2.0", "1.4.1", "1.4.7", "1.5.0"}},
+		{constraint: ">=1.5, <3", expect: []string{"1.5.0", "2.0.0"}},
+		{constraint: ">=2.1.0-0", expect: []string{"2.1.0-rc.1"}},
+		{constraint: "not a constraint", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.constraint, func(t *testing.T) {
+			got, err := Filter(tags, tt.constraint)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.expect) {
+				t.Errorf("got %v, want %v", got, tt.expect)
+			}
+		})
+	}
+}
+
+func TestLatest(t *testing.T) {
+	tags := []string{"latest", "1.4.1", "1.4.7", "1.5.0", "2.0.0", "2.1.0-rc.1"}
+	tests := map[string]string{
+		"~1.4": "1.4.7",
+		"^1":   "1.5.0",
+		"^2":   "2.0.0",
+		">=1":  "2.0.0",
+		"^3":   "",
+	}
+	for constraint, expect := range tests {
+		got, err := Latest(tags, constraint)
+		if expect == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %s", constraint, got)
+			}
+			continue
+		}
+		if err != nil || got != expect {
+			t.Errorf("%s: got %s (%v), want %s", constraint, got, err, expect)
+		}
+	}
+}
+
+func TestNewer(t *testing.T) {
+	tags := []string{"latest", "1.4.1", "1.4.7", "1.5.0", "2.0.0", "2.1.0-rc.1"}
+	tests := map[string]string{
+		"1.4.1":      "2.0.0",
+		"v1.5":       "2.0.0",
+		"2.0.0":      "",
+		"2.1.0-rc.0": "2.1.0-rc.1",
+		"latest":     "",
+	}
+	for current, expect := range tests {
+		if got := Newer(tags, current); got != expect {
+			t.Errorf("%s: got %q, want %q", current, got, expect)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package lock
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FileName is the name of the lock file created in each locked folder
+const FileName = ".tedge-oscar.lck"
+
+// DefaultTimeout is the default time to wait for a lock held by another process
+const DefaultTimeout = 60 * time.Second
+
+// pollInterval is the interval at which a lock held by another process is retried
+const pollInterval = 100 * time.Millisecond
+
+// Lock is an advisory lock of a folder which is shared between tedge-oscar processes.
+// The lock is released by the operating system if the holding process dies.
+type Lock struct {
+	f *os.File
+}
+
+// Acquire takes the exclusive lock of dir, waiting up to timeout for another process to release it
+func Acquire(ctx context.Context, dir string, timeout time.Duration) (*Lock, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, FileName)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+	deadline := time.Now().Add(timeout)
+	waiting := false
+	for {
+		locked, err := tryLock(f)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to lock %s: %w", dir, err)
+		}
+		if locked {
+			break
+		}
+		if !waiting {
+			slog.Info("Waiting for another process to release the lock", "path", dir, "holder", holder(path))
+			waiting = true
+		}
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, fmt.Errorf("%s is locked by another process (%s), gave up after %s", dir, holder(path), timeout)
+		}
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return nil, ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
+
+	// Record the holder so that other processes can report it
+	if err := f.Truncate(0); err == nil {
+		_, _ = f.WriteAt([]byte(fmt.Sprintf("%d\n%s\n", os.Getpid(), strings.Join(os.Args, " "))), 0)
+	}
+	return &Lock{f: f}, nil
+}
+
+// Release releases the lock. The lock file is kept, as removing it would race with other processes.
+func (l *Lock) Release() error {
+	if l == nil || l.f == nil {
+		return nil
+	}
+	_ = l.f.Truncate(0)
+	err := unlock(l.f)
+	if closeErr := l.f.Close(); err == nil {
+		err = closeErr
+	}
+	l.f = nil
+	return err
+}
+
+// holder describes the process holding the lock, e.g. pid 1234: tedge-oscar flows images pull ...
+func holder(path string) string {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "unknown process"
+	}
+	pidValue, command, _ := strings.Cut(strings.TrimSpace(string(b)), "\n")
+	pid, err := strconv.Atoi(pidValue)
+	if err != nil {
+		return "unknown process"
+	}
+	if command == "" {
+		return fmt.Sprintf("pid %d", pid)
+	}
+	return fmt.Sprintf("pid %d: %s", pid, command)
+}
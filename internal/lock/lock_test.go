@@ -0,0 +1,143 @@
+package lock
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// helperEnv makes the test binary hold the lock of a folder until its stdin is closed (see TestMain)
+const helperEnv = "TEDGE_OSCAR_LOCK_HELPER_DIR"
+
+func TestMain(m *testing.M) {
+	if dir := os.Getenv(helperEnv); dir != "" {
+		l, err := Acquire(context.Background(), dir, 0)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println("locked")
+		_, _ = io.Copy(io.Discard, os.Stdin)
+		_ = l.Release()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// lockInProcess holds the lock of dir in another process, returning its pid and a function releasing the lock
+func lockInProcess(t *testing.T, dir string) (int, func()) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(), helperEnv+"="+dir)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			stdin.Close()
+			_ = cmd.Wait()
+		})
+	}
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil || strings.TrimSpace(line) != "locked" {
+		release()
+		t.Fatalf("helper process failed to take the lock. got=%q, err=%v", line, err)
+	}
+	t.Cleanup(release)
+	return cmd.Process.Pid, release
+}
+
+func TestAcquireIsExclusive(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Acquire(context.Background(), dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Acquire(context.Background(), dir, 0); err == nil {
+		t.Fatal("lock was acquired twice")
+	}
+	if err := l.Release(); err != nil {
+		t.Fatal(err)
+	}
+	// Releasing twice is a no-op
+	if err := l.Release(); err != nil {
+		t.Fatal(err)
+	}
+	l, err = Acquire(context.Background(), dir, 0)
+	if err != nil {
+		t.Fatalf("lock can not be acquired after being released: %v", err)
+	}
+	_ = l.Release()
+}
+
+func TestAcquireReportsHolder(t *testing.T) {
+	dir := t.TempDir()
+	pid, _ := lockInProcess(t, dir)
+
+	start := time.Now()
+	_, err := Acquire(context.Background(), dir, 0)
+	if err == nil {
+		t.Fatal("lock held by another process was acquired")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("acquiring the lock without a timeout was blocking. elapsed=%s", elapsed)
+	}
+	if !strings.Contains(err.Error(), fmt.Sprintf("pid %d: ", pid)) || !strings.Contains(err.Error(), os.Args[0]) {
+		t.Errorf("error does not report the pid and command of the holder. got=%v", err)
+	}
+}
+
+func TestAcquireTimeout(t *testing.T) {
+	dir := t.TempDir()
+	lockInProcess(t, dir)
+
+	timeout := 3 * pollInterval
+	start := time.Now()
+	if _, err := Acquire(context.Background(), dir, timeout); err == nil {
+		t.Fatal("lock held by another process was acquired")
+	}
+	if elapsed := time.Since(start); elapsed < timeout {
+		t.Errorf("gave up before the timeout. elapsed=%s", elapsed)
+	}
+}
+
+func TestAcquireWaitsForRelease(t *testing.T) {
+	dir := t.TempDir()
+	_, release := lockInProcess(t, dir)
+	time.AfterFunc(3*pollInterval, release)
+
+	l, err := Acquire(context.Background(), dir, 10*time.Second)
+	if err != nil {
+		t.Fatalf("lock was not acquired once released by the other process: %v", err)
+	}
+	_ = l.Release()
+}
+
+func TestAcquireCanceled(t *testing.T) {
+	dir := t.TempDir()
+	lockInProcess(t, dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(3*pollInterval, cancel)
+	if _, err := Acquire(ctx, dir, time.Minute); !errors.Is(err, context.Canceled) {
+		t.Fatalf("waiting for the lock was not canceled. got=%v", err)
+	}
+}
@@ -0,0 +1,66 @@
+package lockfile
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/BurntSushi/toml"
+
+	"github.com/thin-edge/tedge-oscar/internal/util"
+)
+
+// FileName is the name of the lockfile in the deploy_dir of each mapper
+const FileName = "tedge-oscar.lock"
+
+const header = "# Generated by tedge-oscar, do not edit.\n# Records the image of every instance deployed to this folder.\n\n"
+
+// Entry records the image of a deployed instance
+type Entry struct {
+	// Image is the deployed image, e.g. ghcr.io/thin-edge/counter:1.0 (or ghcr.io/thin-edge/counter:1.0@sha256:... if pinned)
+	Image string `toml:"image" json:"image"`
+	// Requested is the image reference given when deploying, e.g. ghcr.io/thin-edge/counter:^1
+	Requested string `toml:"requested" json:"requested"`
+	// Digest is the manifest digest of the deployed image
+	Digest string `toml:"digest" json:"digest"`
+	// Source is the repository the image was pulled from, either the registry or one of its mirrors
+	Source string `toml:"source,omitempty" json:"source,omitempty"`
+	// Pinned is true if the instance uses the image stored by digest rather than by tag
+	Pinned     bool      `toml:"pinned" json:"pinned"`
+	DeployedAt time.Time `toml:"deployed_at" json:"deployedAt"`
+	// Secrets are the names of the secret params of the image, which are redacted even if the image is no longer available
+	Secrets []string `toml:"secrets,omitempty" json:"secrets,omitempty"`
+}
+
+// File is the lockfile of a deploy_dir, keyed by instance name
+type File struct {
+	Instances map[string]Entry `toml:"instances" json:"instances"`
+}
+
+// Load reads the lockfile of a deploy_dir. A missing lockfile is treated as empty.
+func Load(dir string) (*File, error) {
+	f := &File{Instances: map[string]Entry{}}
+	path := filepath.Join(dir, FileName)
+	if _, err := toml.DecodeFile(path, f); err != nil {
+		if os.IsNotExist(err) {
+			return f, nil
+		}
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	if f.Instances == nil {
+		f.Instances = map[string]Entry{}
+	}
+	return f, nil
+}
+
+// Save writes the lockfile to a deploy_dir
+func (f *File) Save(dir string) error {
+	return util.WriteFileAtomic(filepath.Join(dir, FileName), 0644, func(w io.Writer) error {
+		if _, err := io.WriteString(w, header); err != nil {
+			return err
+		}
+		return toml.NewEncoder(w).Encode(f)
+	})
+}
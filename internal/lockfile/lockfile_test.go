@@ -0,0 +1,38 @@
+package lockfile
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLoadSave(t *testing.T) {
+	dir := t.TempDir()
+	f, err := Load(dir)
+	if err != nil {
+		t.Fatalf("missing lockfile: %v", err)
+	}
+	if len(f.Instances) != 0 {
+		t.Fatalf("expected no instances, got %v", f.Instances)
+	}
+
+	f.Instances["counter"] = Entry{
+		Image:      "ghcr.io/thin-edge/counter:1.4.2@sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+		Requested:  "ghcr.io/thin-edge/counter:^1",
+		Digest:     "sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae",
+		Source:     "cache.site.local:5000/thin-edge/counter",
+		Pinned:     true,
+		DeployedAt: time.Date(2025, 3, 1, 12, 30, 0, 0, time.UTC),
+	}
+	f.Instances["other"] = Entry{Image: "local/other:1.0", Requested: "other:1.0"}
+	if err := f.Save(dir); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, f) {
+		t.Errorf("got %+v, want %+v", got, f)
+	}
+}
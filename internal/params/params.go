@@ -0,0 +1,219 @@
+package params
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+
+	"github.com/thin-edge/tedge-oscar/internal/util"
+	"github.com/thin-edge/tedge-oscar/pkg/maputil"
+)
+
+const (
+	// FileName is the user-owned params file of a flow instance, which is kept when the flow is updated or removed
+	FileName = "params.toml"
+	// TemplateFileName is the file of a flow image documenting the params which can be set
+	TemplateFileName = "params.toml.template"
+)
+
+// commentedAssignment matches the params documented as comments in a template, e.g. "# debug = false"
+var commentedAssignment = regexp.MustCompile(`^\s*#+\s*((\[[A-Za-z0-9_.\-" ]+\])|([A-Za-z0-9_.\-"]+\s*=.*))$`)
+
+// Load reads a params file. A missing file is treated as empty.
+func Load(path string) (map[string]any, error) {
+	params := map[string]any{}
+	if _, err := toml.DecodeFile(path, &params); err != nil {
+		if os.IsNotExist(err) {
+			return params, nil
+		}
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return params, nil
+}
+
+// Save writes a params file, creating its folder if needed
+func Save(path string, params map[string]any) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(path, 0644, func(w io.Writer) error {
+		return toml.NewEncoder(w).Encode(params)
+	})
+}
+
+// LoadTemplate reads the params template of an image, returning nil if the image has none. Templates usually
+// document the params as comments (e.g. "# debug = false"), so commented assignments are read as well.
+func LoadTemplate(path string) (map[string]any, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var uncommented bytes.Buffer
+	for _, line := range strings.Split(string(b), "\n") {
+		if m := commentedAssignment.FindStringSubmatch(line); m != nil {
+			line = m[1]
+		}
+		uncommented.WriteString(line + "\n")
+	}
+	template := map[string]any{}
+	if _, err := toml.Decode(uncommented.String(), &template); err == nil {
+		return template, nil
+	}
+	// e.g. a param which is both commented and set, only the params which are set are used
+	template = map[string]any{}
+	if _, err := toml.Decode(string(b), &template); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return template, nil
+}
+
+// Parse converts key=value assignments to params, where dotted keys set the params of a nested table
+// (e.g. alarm.severity=major). Values are converted to the type of the param in the template (if any),
+// otherwise they are parsed as TOML values, falling back to a string.
+func Parse(assignments []string, template map[string]any) (map[string]any, error) {
+	params := map[string]any{}
+	for _, assignment := range assignments {
+		key, raw, ok := strings.Cut(assignment, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid param %q, expected key=value", assignment)
+		}
+		path := strings.Split(key, ".")
+		expected, _ := lookup(template, path)
+		value, err := parseValue(raw, expected)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of param %s: %w", key, err)
+		}
+		if err := maputil.SetNestedMapValue(params, path, value); err != nil {
+			return nil, fmt.Errorf("invalid param %s: %w", key, err)
+		}
+	}
+	return params, nil
+}
+
+// parseValue converts a raw value to the type of the expected value
+func parseValue(raw string, expected any) (any, error) {
+	var value any
+	var err error
+	switch expected.(type) {
+	case string:
+		return raw, nil
+	case bool:
+		value, err = strconv.ParseBool(raw)
+	case int64:
+		value, err = strconv.ParseInt(raw, 10, 64)
+	case float64:
+		value, err = strconv.ParseFloat(raw, 64)
+	default:
+		var doc struct {
+			Value any `toml:"v"`
+		}
+		if _, err = toml.Decode("v = "+raw, &doc); err != nil && expected == nil {
+			// e.g. a string without quotes
+			return raw, nil
+		}
+		value = doc.Value
+	}
+	if err != nil {
+		return nil, fmt.Errorf("expected a value of type %s, got %q", typeName(expected), raw)
+	}
+	return value, nil
+}
+
+// Validate returns an error if the params set a param which is not defined by the template,
+// or whose type differs from the one of the template
+func Validate(params map[string]any, template map[string]any) error {
+	var problems []string
+	validate(params, template, "", &problems)
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	return fmt.Errorf("invalid params: %s", strings.Join(problems, "; "))
+}
+
+func validate(params map[string]any, template map[string]any, prefix string, problems *[]string) {
+	for key, value := range params {
+		expected, ok := template[key]
+		if !ok {
+			*problems = append(*problems, fmt.Sprintf("unknown param %s%s", prefix, key))
+			continue
+		}
+		if nested, ok := value.(map[string]any); ok {
+			if nestedTemplate, ok := expected.(map[string]any); ok {
+				validate(nested, nestedTemplate, prefix+key+".", problems)
+				continue
+			}
+		}
+		if got, want := typeName(value), typeName(expected); got != want && !(got == "integer" && want == "float") {
+			*problems = append(*problems, fmt.Sprintf("param %s%s must be of type %s, got a value of type %s", prefix, key, want, got))
+		}
+	}
+}
+
+// Flatten returns the params as dotted keys, e.g. alarm.severity, sorted by key
+func Flatten(params map[string]any) ([]string, map[string]any) {
+	flat := map[string]any{}
+	flatten(params, "", flat)
+	keys := make([]string, 0, len(flat))
+	for key := range flat {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, flat
+}
+
+func flatten(params map[string]any, prefix string, flat map[string]any) {
+	for key, value := range params {
+		if nested, ok := value.(map[string]any); ok && len(nested) > 0 {
+			flatten(nested, prefix+key+".", flat)
+			continue
+		}
+		flat[prefix+key] = value
+	}
+}
+
+// lookup returns the value of a nested key
+func lookup(m map[string]any, path []string) (any, bool) {
+	var v any = m
+	for _, key := range path {
+		nested, ok := v.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if v, ok = nested[key]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// typeName returns the TOML type of a decoded value
+func typeName(v any) string {
+	switch v.(type) {
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case int64, int:
+		return "integer"
+	case float64:
+		return "float"
+	case []any, []map[string]any:
+		return "array"
+	case map[string]any:
+		return "table"
+	}
+	return "datetime"
+}
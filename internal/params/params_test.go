@@ -0,0 +1,133 @@
+package params
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadTemplate(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		expect  map[string]any
+	}{
+		{
+			name:    "commented params",
+			content: "# enable debugging\n# debug = false\n\n# alarm severity\n#severity = \"minor\"\n",
+			expect:  map[string]any{"debug": false, "severity": "minor"},
+		},
+		{
+			name:    "set and commented params",
+			content: "threshold = 10\n# debug = true\n",
+			expect:  map[string]any{"threshold": int64(10), "debug": true},
+		},
+		{
+			name:    "commented table",
+			content: "# [alarm]\n# text = \"too hot\"\n",
+			expect:  map[string]any{"alarm": map[string]any{"text": "too hot"}},
+		},
+		{
+			name:    "param commented and set",
+			content: "# debug = false\ndebug = true\n",
+			expect:  map[string]any{"debug": true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), TemplateFileName)
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := LoadTemplate(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.expect) {
+				t.Errorf("got %v, want %v", got, tt.expect)
+			}
+		})
+	}
+	if got, err := LoadTemplate(filepath.Join(t.TempDir(), TemplateFileName)); got != nil || err != nil {
+		t.Errorf("expected no template, got %v (%v)", got, err)
+	}
+}
+
+func TestParse(t *testing.T) {
+	template := map[string]any{
+		"debug":     false,
+		"threshold": int64(10),
+		"ratio":     1.5,
+		"name":      "default",
+		"alarm":     map[string]any{"severity": "minor"},
+	}
+	tests := []struct {
+		name        string
+		assignments []string
+		expect      map[string]any
+		wantErr     bool
+	}{
+		{
+			name:        "typed by template",
+			assignments: []string{"debug=true", "threshold=20", "ratio=2", "name=123"},
+			expect:      map[string]any{"debug": true, "threshold": int64(20), "ratio": 2.0, "name": "123"},
+		},
+		{
+			name:        "nested param",
+			assignments: []string{"alarm.severity=major"},
+			expect:      map[string]any{"alarm": map[string]any{"severity": "major"}},
+		},
+		{
+			name:        "untyped values",
+			assignments: []string{"count=3", "topics=[\"a\", \"b\"]", "text=hello world"},
+			expect:      map[string]any{"count": int64(3), "topics": []any{"a", "b"}, "text": "hello world"},
+		},
+		{
+			name:        "invalid value",
+			assignments: []string{"debug=maybe"},
+			wantErr:     true,
+		},
+		{
+			name:        "missing value",
+			assignments: []string{"debug"},
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.assignments, template)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.expect) {
+				t.Errorf("got %v, want %v", got, tt.expect)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	template := map[string]any{
+		"debug": false,
+		"ratio": 1.5,
+		"alarm": map[string]any{"severity": "minor"},
+	}
+	tests := []struct {
+		name    string
+		params  map[string]any
+		wantErr bool
+	}{
+		{name: "valid", params: map[string]any{"debug": true, "ratio": int64(2), "alarm": map[string]any{"severity": "major"}}},
+		{name: "unknown param", params: map[string]any{"verbose": true}, wantErr: true},
+		{name: "unknown nested param", params: map[string]any{"alarm": map[string]any{"text": "x"}}, wantErr: true},
+		{name: "wrong type", params: map[string]any{"debug": "yes"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Validate(tt.params, template); (err != nil) != tt.wantErr {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,249 @@
+package params
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+
+	"github.com/thin-edge/tedge-oscar/pkg/maputil"
+)
+
+// SchemaFileName is the file of a flow image describing the type of each param. It takes precedence over the params template.
+// Like the template, it has no .toml suffix, so that it is not mistaken for a flow when copied to the folder of an instance.
+const SchemaFileName = "params.toml.schema"
+
+// redacted replaces the value of secret params when they are shown
+const redacted = "********"
+
+// Types of params
+const (
+	TypeString  = "string"
+	TypeInteger = "integer"
+	TypeFloat   = "float"
+	TypeBoolean = "boolean"
+	TypeArray   = "array"
+)
+
+// Types lists the supported types of params
+var Types = []string{TypeString, TypeInteger, TypeFloat, TypeBoolean, TypeArray}
+
+// Param describes a param of a flow
+type Param struct {
+	// Name is the key of the param, where dots refer to nested params, e.g. alarm.severity
+	Name        string `toml:"name" json:"name"`
+	Type        string `toml:"type" json:"type"`
+	Description string `toml:"description" json:"description,omitempty"`
+	Default     any    `toml:"default" json:"default,omitempty"`
+	// Enum lists the allowed values, if restricted
+	Enum     []any `toml:"enum" json:"enum,omitempty"`
+	Required bool  `toml:"required" json:"required,omitempty"`
+	// Secret params (e.g. tokens) are not echoed when prompted for, and are redacted when shown
+	Secret bool `toml:"secret" json:"secret,omitempty"`
+}
+
+// Schema describes the params of a flow
+type Schema struct {
+	Params []Param `toml:"params" json:"params"`
+}
+
+// LoadSchema reads the params schema of an image, returning nil if the image has none
+func LoadSchema(path string) (*Schema, error) {
+	s := &Schema{}
+	if _, err := toml.DecodeFile(path, s); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	if err := s.check(); err != nil {
+		return nil, fmt.Errorf("invalid params schema %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// check returns an error if the schema itself is invalid
+func (s *Schema) check() error {
+	names := map[string]bool{}
+	for _, p := range s.Params {
+		switch {
+		case p.Name == "":
+			return fmt.Errorf("param without a name")
+		case names[p.Name]:
+			return fmt.Errorf("param %s is defined twice", p.Name)
+		case !slices.Contains(Types, p.Type):
+			return fmt.Errorf("param %s has an invalid type %q, expected one of: %s", p.Name, p.Type, strings.Join(Types, ", "))
+		}
+		names[p.Name] = true
+		for _, v := range p.Enum {
+			if !p.hasType(v) {
+				return fmt.Errorf("param %s has an enum value %v which is not a %s", p.Name, v, p.Type)
+			}
+		}
+		if p.Default != nil {
+			if err := p.check(p.Default); err != nil {
+				return fmt.Errorf("invalid default of param %s: %w", p.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Template returns the params of the schema as a params template, i.e. set to the zero value of their type
+func (s *Schema) Template() map[string]any {
+	template := map[string]any{}
+	for _, p := range s.Params {
+		_ = maputil.SetNestedMapValue(template, p.path(), p.zero())
+	}
+	return template
+}
+
+// Defaults returns the default values of the params which have one
+func (s *Schema) Defaults() map[string]any {
+	defaults := map[string]any{}
+	for _, p := range s.Params {
+		if p.Default != nil {
+			_ = maputil.SetNestedMapValue(defaults, p.path(), p.Default)
+		}
+	}
+	return defaults
+}
+
+// Validate returns an error if the params set a param which is not part of the schema,
+// or whose value does not have the expected type or is not one of its allowed values
+func (s *Schema) Validate(params map[string]any) error {
+	if err := Validate(params, s.Template()); err != nil {
+		return err
+	}
+	var problems []string
+	for _, p := range s.Params {
+		if v, ok := lookup(params, p.path()); ok {
+			if err := p.check(v); err != nil {
+				problems = append(problems, fmt.Sprintf("param %s: %s", p.Name, err))
+			}
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	return fmt.Errorf("invalid params: %s", strings.Join(problems, "; "))
+}
+
+// Missing returns the required params which are not set
+func (s *Schema) Missing(params map[string]any) []Param {
+	var missing []Param
+	for _, p := range s.Params {
+		if _, ok := lookup(params, p.path()); p.Required && !ok {
+			missing = append(missing, p)
+		}
+	}
+	return missing
+}
+
+// Redact returns a copy of the params where the values of the secret params are hidden
+func (s *Schema) Redact(params map[string]any) map[string]any {
+	return RedactKeys(params, s.Secrets())
+}
+
+// Secrets returns the names of the secret params
+func (s *Schema) Secrets() []string {
+	var names []string
+	for _, p := range s.Params {
+		if p.Secret {
+			names = append(names, p.Name)
+		}
+	}
+	return names
+}
+
+// RedactKeys returns a copy of the params where the values of the given (dotted) keys are hidden
+func RedactKeys(params map[string]any, secrets []string) map[string]any {
+	return redact(params, func(key string) bool { return slices.Contains(secrets, key) })
+}
+
+// RedactAll returns a copy of the params where all values are hidden, e.g. if it is unknown which params are secret
+func RedactAll(params map[string]any) map[string]any {
+	return redact(params, func(string) bool { return true })
+}
+
+func redact(params map[string]any, secret func(key string) bool) map[string]any {
+	keys, flat := Flatten(params)
+	redactedParams := map[string]any{}
+	for _, key := range keys {
+		value := flat[key]
+		if secret(key) {
+			value = redacted
+		}
+		_ = maputil.SetNestedMapValue(redactedParams, strings.Split(key, "."), value)
+	}
+	return redactedParams
+}
+
+// Set parses a raw value (e.g. typed by the user) and sets the param to it
+func (p Param) Set(params map[string]any, raw string) error {
+	value, err := parseValue(raw, p.zero())
+	if err != nil {
+		return err
+	}
+	if err := p.check(value); err != nil {
+		return err
+	}
+	return maputil.SetNestedMapValue(params, p.path(), value)
+}
+
+// check returns an error if the value does not have the type of the param or is not one of its allowed values
+func (p Param) check(v any) error {
+	if !p.hasType(v) {
+		return fmt.Errorf("expected a value of type %s, got a value of type %s", p.Type, typeName(v))
+	}
+	if len(p.Enum) > 0 && !slices.ContainsFunc(p.Enum, func(e any) bool { return reflect.DeepEqual(p.normalize(e), p.normalize(v)) }) {
+		return fmt.Errorf("%v is not one of the allowed values: %s", v, p.EnumText())
+	}
+	return nil
+}
+
+// EnumText returns the allowed values separated by commas
+func (p Param) EnumText() string {
+	values := make([]string, len(p.Enum))
+	for i, v := range p.Enum {
+		values[i] = fmt.Sprint(v)
+	}
+	return strings.Join(values, ", ")
+}
+
+func (p Param) hasType(v any) bool {
+	got := typeName(v)
+	return got == p.Type || (got == TypeInteger && p.Type == TypeFloat)
+}
+
+func (p Param) path() []string {
+	return strings.Split(p.Name, ".")
+}
+
+// normalize converts integers to floats for float params, so that values can be compared
+func (p Param) normalize(v any) any {
+	if n, ok := v.(int64); ok && p.Type == TypeFloat {
+		return float64(n)
+	}
+	return v
+}
+
+// zero returns the zero value of the type of the param
+func (p Param) zero() any {
+	switch p.Type {
+	case TypeString:
+		return ""
+	case TypeInteger:
+		return int64(0)
+	case TypeFloat:
+		return float64(0)
+	case TypeBoolean:
+		return false
+	}
+	return []any{}
+}
@@ -0,0 +1,116 @@
+package params
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const testSchema = `
+[[params]]
+name = "debug"
+type = "boolean"
+description = "Log the received messages"
+default = false
+
+[[params]]
+name = "alarm.severity"
+type = "string"
+enum = ["minor", "major", "critical"]
+required = true
+
+[[params]]
+name = "ratio"
+type = "float"
+enum = [0.5, 1]
+
+[[params]]
+name = "token"
+type = "string"
+required = true
+secret = true
+`
+
+func TestLoadSchema(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{name: "valid", content: testSchema},
+		{name: "unknown type", content: "[[params]]\nname = \"a\"\ntype = \"number\"\n", wantErr: true},
+		{name: "duplicate param", content: "[[params]]\nname = \"a\"\ntype = \"string\"\n[[params]]\nname = \"a\"\ntype = \"string\"\n", wantErr: true},
+		{name: "default of the wrong type", content: "[[params]]\nname = \"a\"\ntype = \"integer\"\ndefault = \"1\"\n", wantErr: true},
+		{name: "default not in enum", content: "[[params]]\nname = \"a\"\ntype = \"string\"\nenum = [\"x\"]\ndefault = \"y\"\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), SchemaFileName)
+			if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := LoadSchema(path); (err != nil) != tt.wantErr {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+	if s, err := LoadSchema(filepath.Join(t.TempDir(), SchemaFileName)); s != nil || err != nil {
+		t.Errorf("expected no schema, got %v (%v)", s, err)
+	}
+}
+
+func TestSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), SchemaFileName)
+	if err := os.WriteFile(path, []byte(testSchema), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := LoadSchema(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	validateTests := []struct {
+		name    string
+		params  map[string]any
+		wantErr bool
+	}{
+		{name: "valid", params: map[string]any{"debug": true, "alarm": map[string]any{"severity": "major"}, "ratio": int64(1)}},
+		{name: "not in enum", params: map[string]any{"alarm": map[string]any{"severity": "warning"}}, wantErr: true},
+		{name: "float not in enum", params: map[string]any{"ratio": 0.75}, wantErr: true},
+		{name: "wrong type", params: map[string]any{"debug": "true"}, wantErr: true},
+		{name: "unknown param", params: map[string]any{"verbose": true}, wantErr: true},
+	}
+	for _, tt := range validateTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := s.Validate(tt.params); (err != nil) != tt.wantErr {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+
+	instanceParams := map[string]any{"debug": true}
+	missing := s.Missing(instanceParams)
+	if len(missing) != 2 || missing[0].Name != "alarm.severity" || missing[1].Name != "token" {
+		t.Fatalf("unexpected missing params: %v", missing)
+	}
+	if err := missing[0].Set(instanceParams, "warning"); err == nil {
+		t.Error("expected a value which is not in the enum to be rejected")
+	}
+	if err := missing[0].Set(instanceParams, "critical"); err != nil {
+		t.Fatal(err)
+	}
+	if err := missing[1].Set(instanceParams, "s3cr3t"); err != nil {
+		t.Fatal(err)
+	}
+	if missing := s.Missing(instanceParams); len(missing) != 0 {
+		t.Errorf("unexpected missing params: %v", missing)
+	}
+	expect := map[string]any{"debug": true, "alarm": map[string]any{"severity": "critical"}, "token": redacted}
+	if got := s.Redact(instanceParams); !reflect.DeepEqual(got, expect) {
+		t.Errorf("got %v, want %v", got, expect)
+	}
+	if got := s.Defaults(); !reflect.DeepEqual(got, map[string]any{"debug": false}) {
+		t.Errorf("unexpected defaults: %v", got)
+	}
+}
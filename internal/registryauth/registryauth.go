@@ -1,60 +1,45 @@
 package registryauth
 
 import (
-	"encoding/base64"
-	"encoding/json"
+	"context"
 	"fmt"
 	"net/http"
-	"net/url"
 	"os"
-	"strings"
 
+	"oras.land/oras-go/v2/registry/remote"
+	"oras.land/oras-go/v2/registry/remote/auth"
+
+	"github.com/thin-edge/tedge-oscar/internal/artifact"
 	"github.com/thin-edge/tedge-oscar/internal/config"
 )
 
 var debugHTTP bool
 
+// tokenCache caches the tokens per registry and scope for the lifetime of the process
+var tokenCache = auth.NewCache()
+
 // SetDebugHTTP sets whether HTTP debug output is enabled for registry communication.
 func SetDebugHTTP(level string) {
 	debugHTTP = (level == "debug")
 }
 
-type AuthResult struct {
-	Client   *http.Client
-	Username string
-	Password string
-	Token    string
+type roundTripperWithDebug struct {
+	base http.RoundTripper
 }
 
-type roundTripperWithBasicAuth struct {
-	base     http.RoundTripper
-	username string
-	password string
-}
-
-func (rt roundTripperWithBasicAuth) RoundTrip(req *http.Request) (*http.Response, error) {
-	if rt.username != "" {
-		auth := rt.username + ":" + rt.password
-		header := "Basic " + base64.StdEncoding.EncodeToString([]byte(auth))
-		req.Header.Set("Authorization", header)
-	}
+func (rt roundTripperWithDebug) RoundTrip(req *http.Request) (*http.Response, error) {
 	if debugHTTP {
 		printHTTPRequest(req)
 	}
-	return rt.base.RoundTrip(req)
-}
-
-type roundTripperWithBearerToken struct {
-	base  http.RoundTripper
-	token string
-}
-
-func (rt roundTripperWithBearerToken) RoundTrip(req *http.Request) (*http.Response, error) {
-	req.Header.Set("Authorization", "Bearer "+rt.token)
-	if debugHTTP {
-		printHTTPRequest(req)
+	resp, err := rt.base.RoundTrip(req)
+	if debugHTTP && resp != nil {
+		fmt.Fprintf(os.Stderr, "--- HTTP Response ---\n%s\n", resp.Status)
+		if v := resp.Header.Get("Www-Authenticate"); v != "" {
+			fmt.Fprintf(os.Stderr, "Www-Authenticate: %s\n", v)
+		}
+		fmt.Fprintln(os.Stderr, "-------------------")
 	}
-	return rt.base.RoundTrip(req)
+	return resp, err
 }
 
 func printHTTPRequest(req *http.Request) {
@@ -68,52 +53,48 @@ func printHTTPRequest(req *http.Request) {
 	fmt.Fprintln(os.Stderr, "-------------------")
 }
 
-// GetAuthenticatedClient returns an http.Client with the appropriate auth for the registry, or nil if no auth is needed.
-// If the registry is ghcr.io and username/password are present, it will fetch a Bearer token for the given scope.
-func GetAuthenticatedClient(cfg *config.Config, repoRef, scope string) (*http.Client, string, string, string, error) {
-	u, err := url.Parse("https://" + repoRef)
+// NewClient returns a client which authenticates to the given registry using the standard
+// Docker/OCI token flow. The WWW-Authenticate challenge of the registry is used to either
+// send the stored credential as basic auth, or to request a token for the scope of the
+// request from the advertised realm. Tokens are cached per scope and refreshed when rejected.
+// The transport settings of the registry (TLS, proxy) are applied if configured, and failed
+// requests are retried according to the retry settings.
+func NewClient(cfg *config.Config, registry string) (*auth.Client, error) {
+	transport, err := newTransport(cfg.FindRegistry(registry))
 	if err != nil {
-		return nil, "", "", "", fmt.Errorf("invalid repoRef: %w", err)
-	}
-	reg := u.Host
-	var username, password string
-	if cred := cfg.FindCredential(reg); cred != nil {
-		username = cred.Username
-		password = cred.Password
+		return nil, err
 	}
-	token := ""
-	if reg == "ghcr.io" && username != "" && password != "" {
-		if scope == "" {
-			ownerRepo := strings.TrimPrefix(repoRef, "ghcr.io/")
-			scope = "repository:" + ownerRepo + ":pull"
-		}
-		tokenURL := "https://ghcr.io/token?service=ghcr.io&scope=" + url.QueryEscape(scope)
-		req, err := http.NewRequest("GET", tokenURL, nil)
-		if err == nil {
-			req.SetBasicAuth(username, password)
-			resp, err := http.DefaultClient.Do(req)
-			if err == nil && resp.StatusCode == 200 {
-				defer resp.Body.Close()
-				type tokenResp struct {
-					Token string `json:"token"`
-				}
-				var tr tokenResp
-				if err := json.NewDecoder(resp.Body).Decode(&tr); err == nil && tr.Token != "" {
-					token = tr.Token
-				}
+	return &auth.Client{
+		Client: &http.Client{
+			Transport: newRetryTransport(roundTripperWithDebug{transport}, cfg.Retry),
+		},
+		Cache: tokenCache,
+		Credential: func(ctx context.Context, hostport string) (auth.Credential, error) {
+			// Use the registry name rather than the host, e.g. docker.io instead of registry-1.docker.io
+			if cred := cfg.FindCredential(registry); cred != nil && cred.Username != "" && cred.Password != "" {
+				return auth.Credential{
+					Username: cred.Username,
+					Password: cred.Password,
+				}, nil
 			}
-		}
+			return auth.EmptyCredential, nil
+		},
+	}, nil
+}
+
+// NewRepository returns a remote repository for the image reference using an authenticated client
+func NewRepository(cfg *config.Config, ref artifact.Reference) (*remote.Repository, error) {
+	repo, err := remote.NewRepository(ref.Host() + "/" + ref.Repository)
+	if err != nil {
+		return nil, fmt.Errorf("invalid repository: %w", err)
+	}
+	client, err := NewClient(cfg, ref.Registry)
+	if err != nil {
+		return nil, err
 	}
-	if token != "" {
-		base := http.DefaultTransport
-		return &http.Client{
-			Transport: roundTripperWithBearerToken{base, token},
-		}, username, password, token, nil
-	} else if username != "" && password != "" {
-		base := http.DefaultTransport
-		return &http.Client{
-			Transport: roundTripperWithBasicAuth{base, username, password},
-		}, username, password, "", nil
+	repo.Client = client
+	if reg := cfg.FindRegistry(ref.Registry); reg != nil {
+		repo.PlainHTTP = reg.PlainHTTP
 	}
-	return nil, "", "", "", nil
+	return repo, nil
 }
@@ -0,0 +1,114 @@
+package registryauth
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+
+	"oras.land/oras-go/v2/registry/remote/retry"
+
+	"github.com/thin-edge/tedge-oscar/internal/config"
+)
+
+// retryPolicy retries requests which failed due to network errors (e.g. a connection reset)
+// or with a 408, 429 or 5xx status, using an exponential backoff with jitter.
+// The Retry-After header sent along with a 429 or 503 status takes precedence over the backoff,
+// but is limited to the maximum wait so that a registry can not stall a pull for a long time.
+type retryPolicy struct {
+	cfg config.RetryConfig
+}
+
+func newRetryTransport(base http.RoundTripper, cfg config.RetryConfig) http.RoundTripper {
+	if cfg.Attempts <= 0 {
+		return base
+	}
+	transport := retry.NewTransport(base)
+	transport.Policy = func() retry.Policy { return &retryPolicy{cfg: cfg} }
+	return transport
+}
+
+func (p *retryPolicy) Retry(attempt int, resp *http.Response, err error) (time.Duration, error) {
+	if attempt >= p.cfg.Attempts {
+		return -1, nil
+	}
+	if err != nil {
+		if !isRetryableError(err) {
+			return -1, nil
+		}
+		wait := Backoff(p.cfg, attempt)
+		slog.Warn("Registry request failed, retrying", "error", err, "attempt", attempt+1, "wait", wait)
+		return wait, nil
+	}
+	switch {
+	case resp.StatusCode == http.StatusRequestTimeout,
+		resp.StatusCode == http.StatusTooManyRequests,
+		resp.StatusCode >= http.StatusInternalServerError && resp.StatusCode != http.StatusNotImplemented:
+	default:
+		return -1, nil
+	}
+	wait, ok := retryAfter(resp)
+	if !ok {
+		wait = Backoff(p.cfg, attempt)
+	} else if p.cfg.MaxWait > 0 && wait > p.cfg.MaxWait {
+		wait = p.cfg.MaxWait
+	}
+	slog.Warn("Registry request failed, retrying", "url", resp.Request.URL.Redacted(), "status", resp.Status, "attempt", attempt+1, "wait", wait)
+	return wait, nil
+}
+
+// Backoff returns the wait before the given retry attempt (starting from 0)
+func Backoff(cfg config.RetryConfig, attempt int) time.Duration {
+	wait := cfg.MinWait
+	for i := 0; i < attempt && wait < cfg.MaxWait; i++ {
+		wait *= 2
+	}
+	if cfg.MaxWait > 0 && wait > cfg.MaxWait {
+		wait = cfg.MaxWait
+	}
+	if cfg.Jitter > 0 && wait > 0 {
+		// Spread the wait evenly over [wait-jitter, wait+jitter]
+		delta := time.Duration(cfg.Jitter * float64(wait))
+		wait += time.Duration(rand.Int64N(int64(2*delta)+1)) - delta
+	}
+	return wait
+}
+
+// retryAfter returns the wait requested by the Retry-After header of a 429 or 503 response,
+// which is either a number of seconds or an HTTP date
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(v); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0), true
+	}
+	return 0, false
+}
+
+// isRetryableError returns false for errors which would fail again, e.g. an untrusted certificate
+func isRetryableError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var certErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	if errors.As(err, &certErr) || errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) || errors.As(err, &invalidErr) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,125 @@
+package registryauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/thin-edge/tedge-oscar/internal/config"
+)
+
+func TestBackoff(t *testing.T) {
+	cfg := config.RetryConfig{MinWait: 100 * time.Millisecond, MaxWait: time.Second}
+	tests := []struct {
+		attempt int
+		expect  time.Duration
+	}{
+		{attempt: 0, expect: 100 * time.Millisecond},
+		{attempt: 1, expect: 200 * time.Millisecond},
+		{attempt: 3, expect: 800 * time.Millisecond},
+		{attempt: 4, expect: time.Second},
+		{attempt: 100, expect: time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.attempt), func(t *testing.T) {
+			if got := Backoff(cfg, tt.attempt); got != tt.expect {
+				t.Errorf("unexpected wait. got=%s, expected=%s", got, tt.expect)
+			}
+		})
+	}
+
+	cfg.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got := Backoff(cfg, 1); got < 100*time.Millisecond || got > 300*time.Millisecond {
+			t.Fatalf("wait is outside of the jitter. got=%s", got)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		header string
+		// min and max bound the expected wait, as an HTTP date is relative to now
+		min, max time.Duration
+		ok       bool
+	}{
+		{name: "seconds", status: http.StatusTooManyRequests, header: "3", min: 3 * time.Second, max: 3 * time.Second, ok: true},
+		{name: "zero seconds", status: http.StatusServiceUnavailable, header: "0", ok: true},
+		{name: "http date", status: http.StatusServiceUnavailable, header: time.Now().Add(10 * time.Second).UTC().Format(http.TimeFormat), min: 8 * time.Second, max: 10 * time.Second, ok: true},
+		{name: "http date in the past", status: http.StatusTooManyRequests, header: time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), ok: true},
+		{name: "negative seconds", status: http.StatusTooManyRequests, header: "-1"},
+		{name: "invalid", status: http.StatusTooManyRequests, header: "soon"},
+		{name: "missing", status: http.StatusTooManyRequests},
+		{name: "other status", status: http.StatusInternalServerError, header: "3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: tt.status, Header: http.Header{}}
+			if tt.header != "" {
+				resp.Header.Set("Retry-After", tt.header)
+			}
+			wait, ok := retryAfter(resp)
+			if ok != tt.ok {
+				t.Fatalf("unexpected result. got=%v, expected=%v", ok, tt.ok)
+			}
+			if wait < tt.min || wait > tt.max {
+				t.Errorf("unexpected wait. got=%s, expected between %s and %s", wait, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	tests := []struct {
+		name string
+		// statuses are the responses of the server in order, the last one is repeated
+		statuses   []int
+		retryAfter string
+		attempts   int
+		// expectRequests is the number of requests sent, and expectStatus the status returned to the caller
+		expectRequests int
+		expectStatus   int
+	}{
+		{name: "success", statuses: []int{http.StatusOK}, attempts: 3, expectRequests: 1, expectStatus: http.StatusOK},
+		{name: "server error is retried", statuses: []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusOK}, attempts: 3, expectRequests: 3, expectStatus: http.StatusOK},
+		{name: "request timeout is retried", statuses: []int{http.StatusRequestTimeout, http.StatusOK}, attempts: 3, expectRequests: 2, expectStatus: http.StatusOK},
+		{name: "attempts are limited", statuses: []int{http.StatusInternalServerError}, attempts: 2, expectRequests: 3, expectStatus: http.StatusInternalServerError},
+		{name: "not found is not retried", statuses: []int{http.StatusNotFound}, attempts: 3, expectRequests: 1, expectStatus: http.StatusNotFound},
+		{name: "not implemented is not retried", statuses: []int{http.StatusNotImplemented}, attempts: 3, expectRequests: 1, expectStatus: http.StatusNotImplemented},
+		{name: "retries are disabled", statuses: []int{http.StatusServiceUnavailable, http.StatusOK}, attempts: 0, expectRequests: 1, expectStatus: http.StatusServiceUnavailable},
+		{name: "retry after is limited to the maximum wait", statuses: []int{http.StatusTooManyRequests, http.StatusOK}, retryAfter: "3600", attempts: 3, expectRequests: 2, expectStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				i := int(requests.Add(1)) - 1
+				status := tt.statuses[min(i, len(tt.statuses)-1)]
+				if tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				w.WriteHeader(status)
+			}))
+			defer server.Close()
+
+			cfg := config.RetryConfig{Attempts: tt.attempts, MinWait: time.Millisecond, MaxWait: 10 * time.Millisecond}
+			client := &http.Client{Transport: newRetryTransport(http.DefaultTransport, cfg), Timeout: 5 * time.Second}
+			resp, err := client.Get(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if got := int(requests.Load()); got != tt.expectRequests {
+				t.Errorf("unexpected number of requests. got=%d, expected=%d", got, tt.expectRequests)
+			}
+			if resp.StatusCode != tt.expectStatus {
+				t.Errorf("unexpected status. got=%d, expected=%d", resp.StatusCode, tt.expectStatus)
+			}
+		})
+	}
+}
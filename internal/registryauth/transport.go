@@ -0,0 +1,68 @@
+package registryauth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/thin-edge/tedge-oscar/internal/config"
+)
+
+// newTransport returns the transport used to connect to a registry, applying the
+// TLS and proxy settings of the registry (if configured).
+func newTransport(reg *config.RegistryCredential) (http.RoundTripper, error) {
+	if reg == nil {
+		return http.DefaultTransport, nil
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: reg.InsecureSkipVerify,
+	}
+	if reg.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := os.ReadFile(reg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca_file of registry %s: %w", reg.Registry, err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ca_file of registry %s does not contain any PEM encoded certificates. path=%s", reg.Registry, reg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	certPath, keyPath := reg.ClientCert, reg.ClientKey
+	switch reg.Auth {
+	case "", config.AuthCredentials:
+	case config.AuthDeviceCert:
+		if certPath == "" && keyPath == "" {
+			device, err := config.LoadTedgeDevice()
+			if err != nil {
+				return nil, fmt.Errorf("failed to read the thin-edge.io device certificate settings: %w", err)
+			}
+			certPath, keyPath = device.CertPath, device.KeyPath
+		}
+	default:
+		return nil, fmt.Errorf("unsupported auth mode of registry %s: %s (expected %s or %s)", reg.Registry, reg.Auth, config.AuthCredentials, config.AuthDeviceCert)
+	}
+	if certPath != "" || keyPath != "" {
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate of registry %s: %w", reg.Registry, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport.TLSClientConfig = tlsConfig
+	if reg.Proxy != "" {
+		proxyURL, err := url.Parse(reg.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy of registry %s: %w", reg.Registry, err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	return transport, nil
+}
@@ -0,0 +1,49 @@
+package util
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "instance.toml")
+	write := func(content string) func(io.Writer) error {
+		return func(w io.Writer) error {
+			_, err := io.WriteString(w, content)
+			return err
+		}
+	}
+
+	if err := WriteFileAtomic(path, 0644, write("v1")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := WriteFileAtomic(path, 0644, write("v2")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// A failed write leaves the current version untouched
+	err := WriteFileAtomic(path, 0644, func(w io.Writer) error {
+		_, _ = io.WriteString(w, "partial")
+		return errors.New("encode failed")
+	})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	for file, want := range map[string]string{path: "v2", path + BackupSuffix: "v1"} {
+		got, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", file, err)
+		}
+		if string(got) != want {
+			t.Errorf("%s: got %q, want %q", filepath.Base(file), got, want)
+		}
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 2 {
+		t.Errorf("expected no temporary files to be left, got %d entries", len(entries))
+	}
+}
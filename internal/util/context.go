@@ -0,0 +1,23 @@
+package util
+
+import (
+	"context"
+	"io"
+)
+
+type contextReader struct {
+	ctx context.Context
+	io.ReadCloser
+}
+
+// NewContextReader returns a reader which fails once the context is cancelled
+func NewContextReader(ctx context.Context, r io.ReadCloser) io.ReadCloser {
+	return &contextReader{ctx: ctx, ReadCloser: r}
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.ReadCloser.Read(p)
+}
@@ -0,0 +1,49 @@
+package util
+
+import "testing"
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name   string
+		a      string
+		b      string
+		expect string
+	}{
+		{
+			name: "equal",
+			a:    "a\nb\n",
+			b:    "a\nb\n",
+		},
+		{
+			name:   "changed line",
+			a:      "a\nb\nc\n",
+			b:      "a\nB\nc\n",
+			expect: "--- old\n+++ new\n@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n",
+		},
+		{
+			name:   "added lines at the end",
+			a:      "a\n",
+			b:      "a\nb\nc\n",
+			expect: "--- old\n+++ new\n@@ -1 +1,3 @@\n a\n+b\n+c\n",
+		},
+		{
+			name:   "from empty",
+			a:      "",
+			b:      "a\n",
+			expect: "--- old\n+++ new\n@@ -0,0 +1 @@\n+a\n",
+		},
+		{
+			name:   "separate hunks",
+			a:      "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n",
+			b:      "one\n2\n3\n4\n5\n6\n7\n8\n9\nten\n",
+			expect: "--- old\n+++ new\n@@ -1,4 +1,4 @@\n-1\n+one\n 2\n 3\n 4\n@@ -7,4 +7,4 @@\n 7\n 8\n 9\n-10\n+ten\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Diff("old", "new", tt.a, tt.b); got != tt.expect {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.expect)
+			}
+		})
+	}
+}
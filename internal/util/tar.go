@@ -0,0 +1,46 @@
+package util
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ExtractTar extracts the regular files of a tar stream to outputDir.
+func ExtractTar(r io.Reader, outputDir string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading tarball: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue // skip non-regular files
+		}
+		if strings.Contains(hdr.Name, "..") {
+			slog.Warn("Skipping file as it uses '..' within the path. This is not allowed to prevent path traversal attacks.", "name", hdr.Name)
+			continue
+		}
+		outPath := filepath.Join(outputDir, hdr.Name)
+		if err := os.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
+			return fmt.Errorf("failed to create directory: %w", err)
+		}
+		outFile, err := os.Create(outPath)
+		if err != nil {
+			return fmt.Errorf("failed to create file: %w", err)
+		}
+		if _, err := io.Copy(outFile, tr); err != nil {
+			outFile.Close()
+			return fmt.Errorf("failed to extract file: %w", err)
+		}
+		outFile.Close()
+	}
+	return nil
+}
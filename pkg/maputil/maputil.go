@@ -1,6 +1,9 @@
 package maputil
 
-import "fmt"
+import (
+	"fmt"
+	"reflect"
+)
 
 // SetNestedMapValue sets a value in a nested map[string]any given a path of keys.
 func SetNestedMapValue(m map[string]any, path []string, value any) error {
@@ -27,3 +30,74 @@ func SetNestedMapValue(m map[string]any, path []string, value any) error {
 	}
 	return nil
 }
+
+// MergeChanges applies the changes which turned base into current onto next. Values which were added or
+// modified in current are copied to next, and keys which were removed from base are removed from next.
+// Nested maps and arrays of maps (e.g. TOML arrays of tables) are merged element by element.
+func MergeChanges(base, current, next map[string]any) {
+	for key, cv := range current {
+		bv, inBase := base[key]
+		if inBase && reflect.DeepEqual(cv, bv) {
+			continue
+		}
+		nv, inNext := next[key]
+		if cm, ok := cv.(map[string]any); ok && inNext {
+			if nm, ok := nv.(map[string]any); ok {
+				bm, _ := bv.(map[string]any)
+				MergeChanges(bm, cm, nm)
+				continue
+			}
+		}
+		if cl, ok := mapSlice(cv); ok && inNext {
+			if nl, ok := mapSlice(nv); ok {
+				bl, _ := mapSlice(bv)
+				for i := 0; i < len(nl) && i < len(cl); i++ {
+					var bm map[string]any
+					if i < len(bl) {
+						bm = bl[i]
+					}
+					MergeChanges(bm, cl[i], nl[i])
+				}
+				continue
+			}
+		}
+		next[key] = cv
+	}
+	for key := range base {
+		if _, ok := current[key]; !ok {
+			delete(next, key)
+		}
+	}
+}
+
+// mapSlice returns the elements of a non-empty slice of maps. The maps are shared with the slice.
+func mapSlice(v any) ([]map[string]any, bool) {
+	switch s := v.(type) {
+	case []map[string]any:
+		return s, len(s) > 0
+	case []any:
+		maps := make([]map[string]any, len(s))
+		for i, item := range s {
+			m, ok := item.(map[string]any)
+			if !ok {
+				return nil, false
+			}
+			maps[i] = m
+		}
+		return maps, len(maps) > 0
+	}
+	return nil, false
+}
+
+// Merge copies the values of src into dst. Nested maps are merged key by key, other values are replaced.
+func Merge(dst, src map[string]any) {
+	for key, sv := range src {
+		if sm, ok := sv.(map[string]any); ok {
+			if dm, ok := dst[key].(map[string]any); ok {
+				Merge(dm, sm)
+				continue
+			}
+		}
+		dst[key] = sv
+	}
+}
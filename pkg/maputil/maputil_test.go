@@ -70,6 +70,101 @@ func TestSetNestedMapValue(t *testing.T) {
 	}
 }
 
+func TestMergeChanges(t *testing.T) {
+	tests := []struct {
+		name    string
+		base    map[string]any
+		current map[string]any
+		next    map[string]any
+		expect  map[string]any
+	}{
+		{
+			name:    "keep new defaults",
+			base:    map[string]any{"a": 1, "b": 2},
+			current: map[string]any{"a": 1, "b": 2},
+			next:    map[string]any{"a": 10, "c": 3},
+			expect:  map[string]any{"a": 10, "c": 3},
+		},
+		{
+			name:    "carry over modified and added values",
+			base:    map[string]any{"a": 1},
+			current: map[string]any{"a": 5, "extra": "x"},
+			next:    map[string]any{"a": 10},
+			expect:  map[string]any{"a": 5, "extra": "x"},
+		},
+		{
+			name:    "carry over removed values",
+			base:    map[string]any{"a": 1, "b": 2},
+			current: map[string]any{"a": 1},
+			next:    map[string]any{"a": 1, "b": 20},
+			expect:  map[string]any{"a": 1},
+		},
+		{
+			name:    "nested maps",
+			base:    map[string]any{"input": map[string]any{"mqtt": map[string]any{"topics": []any{"a"}}}},
+			current: map[string]any{"input": map[string]any{"mqtt": map[string]any{"topics": []any{"b"}}}},
+			next:    map[string]any{"input": map[string]any{"mqtt": map[string]any{"topics": []any{"a"}, "qos": 1}}},
+			expect:  map[string]any{"input": map[string]any{"mqtt": map[string]any{"topics": []any{"b"}, "qos": 1}}},
+		},
+		{
+			name: "arrays of tables",
+			base: map[string]any{"steps": []map[string]any{
+				{"script": "old/main.js", "config": map[string]any{"threshold": 1}},
+			}},
+			current: map[string]any{"steps": []map[string]any{
+				{"script": "old/main.js", "interval": "10s", "config": map[string]any{"threshold": 5}},
+			}},
+			next: map[string]any{"steps": []map[string]any{
+				{"script": "new/main.js", "config": map[string]any{"threshold": 1, "unit": "C"}},
+				{"script": "new/other.js"},
+			}},
+			expect: map[string]any{"steps": []map[string]any{
+				{"script": "new/main.js", "interval": "10s", "config": map[string]any{"threshold": 5, "unit": "C"}},
+				{"script": "new/other.js"},
+			}},
+		},
+		{
+			name:    "no base",
+			base:    nil,
+			current: map[string]any{"a": 5},
+			next:    map[string]any{"a": 10, "b": 1},
+			expect:  map[string]any{"a": 5, "b": 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			MergeChanges(tt.base, tt.current, tt.next)
+			if !reflect.DeepEqual(tt.next, tt.expect) {
+				t.Errorf("expected map: %#v, got: %#v", tt.expect, tt.next)
+			}
+		})
+	}
+}
+
+func TestMerge(t *testing.T) {
+	dst := map[string]any{
+		"debug": false,
+		"alarm": map[string]any{"severity": "minor", "text": "high temperature"},
+		"tags":  []any{"a"},
+	}
+	src := map[string]any{
+		"debug": true,
+		"alarm": map[string]any{"severity": "major"},
+		"tags":  []any{"b", "c"},
+		"unit":  "C",
+	}
+	expect := map[string]any{
+		"debug": true,
+		"alarm": map[string]any{"severity": "major", "text": "high temperature"},
+		"tags":  []any{"b", "c"},
+		"unit":  "C",
+	}
+	Merge(dst, src)
+	if !reflect.DeepEqual(dst, expect) {
+		t.Errorf("got %v, want %v", dst, expect)
+	}
+}
+
 func copyMap(src map[string]any) map[string]any {
 	if src == nil {
 		return nil
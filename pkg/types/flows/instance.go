@@ -1,7 +1,8 @@
 package flows
 
 type InstanceStep struct {
-	Script string `toml:"script"`
+	Script  string `toml:"script"`
+	Builtin string `toml:"builtin"`
 }
 
 type InstanceInputMQTT struct {
@@ -13,6 +14,19 @@ type InstanceInput struct {
 }
 
 type InstanceFile struct {
-	Input InstanceInput  `toml:"input"`
-	Steps []InstanceStep `toml:"steps"`
+	// Version is the version of the flow definition, if any
+	Version string         `toml:"version"`
+	Input   InstanceInput  `toml:"input"`
+	Steps   []InstanceStep `toml:"steps"`
+}
+
+// Script returns the script of the first step which runs a script (rather than a built-in
+// function of the flows engine), or an empty string if there is none
+func (f InstanceFile) Script() string {
+	for _, step := range f.Steps {
+		if step.Script != "" {
+			return step.Script
+		}
+	}
+	return ""
 }